@@ -24,21 +24,69 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/seaweedfs/seaweedfs-cosi-driver/pkg/driver"
 	"github.com/seaweedfs/seaweedfs-cosi-driver/pkg/envflag"
 	"github.com/seaweedfs/seaweedfs/weed/security"
 	"github.com/seaweedfs/seaweedfs/weed/util"
 	"k8s.io/klog/v2"
-	"sigs.k8s.io/container-object-storage-interface-provisioner-sidecar/pkg/provisioner"
 )
 
 type runOptions struct {
-	driverName    string
-	cosiEndpoint  string
-	filerEndpoint string
-	endpoint      string
-	region        string
+	driverName     string
+	cosiEndpoint   string
+	filerEndpoint  string
+	endpoint       string
+	region         string
+	iamBatchWindow time.Duration
+	iamConfigCache bool
+
+	masterEndpoint           string
+	filerHealthCheckInterval time.Duration
+
+	filerRetryAttempts           int
+	filerRetryBackoff            time.Duration
+	filerRetryMaxBackoff         time.Duration
+	filerCircuitBreakerThreshold int
+	filerCircuitBreakerCooldown  time.Duration
+
+	identityBackend    string
+	iamEndpoint        string
+	iamAccessKeyID     string
+	iamSecretAccessKey string
+
+	identityPrefix          string
+	adoptExistingIdentities bool
+
+	keyRotationOverlap      time.Duration
+	maxKeyAge               time.Duration
+	credentialCheckInterval time.Duration
+	adminAddress            string
+	adminTokenFile          string
+
+	healthAddress       string
+	healthCheckInterval time.Duration
+	metricsAddress      string
+	startupCheckTimeout time.Duration
+	strictFilerVersion  bool
+	tracesExporter      string
+
+	bucketPolicy      bool
+	s3AccessKeyID     string
+	s3SecretAccessKey string
+
+	anonymousAccessAllowlist []string
+
+	pathStyle        bool
+	caBundleFile     string
+	signatureVersion string
+
+	leaderElection         bool
+	leaderElectionLease    time.Duration
+	leaderElectionIdentity string
+
+	clustersConfig string
 }
 
 func main() {
@@ -46,11 +94,59 @@ func main() {
 	flag.Parse()
 
 	opts := runOptions{
-		driverName:    envflag.String("DRIVERNAME", "seaweedfs.objectstorage.k8s.io"),
-		cosiEndpoint:  envflag.String("COSI_ENDPOINT", "unix:///var/lib/cosi/cosi.sock"),
-		filerEndpoint: envflag.String("SEAWEEDFS_FILER", ""),
-		endpoint:      envflag.String("ENDPOINT", ""),
-		region:        envflag.String("REGION", ""),
+		driverName:     envflag.String("DRIVERNAME", "seaweedfs.objectstorage.k8s.io"),
+		cosiEndpoint:   envflag.String("COSI_ENDPOINT", "unix:///var/lib/cosi/cosi.sock"),
+		filerEndpoint:  envflag.String("SEAWEEDFS_FILER", ""),
+		endpoint:       envflag.String("ENDPOINT", ""),
+		region:         envflag.String("REGION", ""),
+		iamBatchWindow: envflag.Duration("IAM_BATCH_WINDOW", 10*time.Millisecond),
+		iamConfigCache: envflag.Bool("IAM_CONFIG_CACHE", true),
+
+		masterEndpoint:           envflag.String("SEAWEEDFS_MASTER", ""),
+		filerHealthCheckInterval: envflag.Duration("FILER_HEALTH_CHECK_INTERVAL", 10*time.Second),
+
+		filerRetryAttempts:           envflag.Int("FILER_RETRY_ATTEMPTS", 5),
+		filerRetryBackoff:            envflag.Duration("FILER_RETRY_BACKOFF", 100*time.Millisecond),
+		filerRetryMaxBackoff:         envflag.Duration("FILER_RETRY_MAX_BACKOFF", 2*time.Second),
+		filerCircuitBreakerThreshold: envflag.Int("FILER_CIRCUIT_BREAKER_THRESHOLD", 5),
+		filerCircuitBreakerCooldown:  envflag.Duration("FILER_CIRCUIT_BREAKER_COOLDOWN", 30*time.Second),
+
+		identityBackend:    envflag.String("IDENTITY_BACKEND", driver.IdentityBackendFiler, driver.IdentityBackendFiler, driver.IdentityBackendIAM),
+		iamEndpoint:        envflag.String("IAM_ENDPOINT", ""),
+		iamAccessKeyID:     envflag.String("IAM_ACCESS_KEY_ID", ""),
+		iamSecretAccessKey: envflag.String("IAM_SECRET_ACCESS_KEY", ""),
+
+		identityPrefix:          envflag.String("IDENTITY_PREFIX", ""),
+		adoptExistingIdentities: envflag.Bool("ADOPT_EXISTING_IDENTITIES", false),
+
+		keyRotationOverlap:      envflag.Duration("KEY_ROTATION_OVERLAP", 24*time.Hour),
+		maxKeyAge:               envflag.Duration("MAX_KEY_AGE", 0),
+		credentialCheckInterval: envflag.Duration("CREDENTIAL_CHECK_INTERVAL", time.Minute),
+		adminAddress:            envflag.String("ADMIN_ADDRESS", ""),
+		adminTokenFile:          envflag.String("ADMIN_TOKEN_FILE", ""),
+
+		healthAddress:       envflag.String("HEALTH_ADDRESS", ""),
+		healthCheckInterval: envflag.Duration("HEALTH_CHECK_INTERVAL", 10*time.Second),
+		metricsAddress:      envflag.String("METRICS_ADDRESS", ""),
+		startupCheckTimeout: envflag.Duration("STARTUP_CHECK_TIMEOUT", 10*time.Second),
+		strictFilerVersion:  envflag.Bool("STRICT_FILER_VERSION", false),
+		tracesExporter:      envflag.String("OTEL_TRACES_EXPORTER", driver.TracesExporterNone, driver.TracesExporterNone, driver.TracesExporterOTLP),
+
+		bucketPolicy:      envflag.Bool("BUCKET_POLICY", false),
+		s3AccessKeyID:     envflag.String("S3_ACCESS_KEY_ID", ""),
+		s3SecretAccessKey: envflag.String("S3_SECRET_ACCESS_KEY", ""),
+
+		anonymousAccessAllowlist: envflag.StringList("ANONYMOUS_ACCESS_ALLOWLIST", nil),
+
+		pathStyle:        envflag.Bool("PATH_STYLE", true),
+		caBundleFile:     envflag.String("CA_BUNDLE_FILE", ""),
+		signatureVersion: envflag.String("SIGNATURE_VERSION", driver.SignatureVersionV4, driver.SignatureVersionV4, driver.SignatureVersionV2),
+
+		leaderElection:         envflag.Bool("LEADER_ELECTION", false),
+		leaderElectionLease:    envflag.Duration("LEADER_ELECTION_LEASE", 15*time.Second),
+		leaderElectionIdentity: envflag.String("LEADER_ELECTION_IDENTITY", ""),
+
+		clustersConfig: envflag.String("CLUSTERS_CONFIG", ""),
 	}
 
 	if err := run(context.Background(), opts); err != nil {
@@ -67,28 +163,87 @@ func run(ctx context.Context, opts runOptions) error {
 	)
 	defer stop()
 
+	shutdownTracing, err := driver.SetupTracing(ctx, opts.tracesExporter)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			klog.ErrorS(err, "failed to flush traces")
+		}
+	}()
+
 	util.LoadConfiguration("security", false)
 	grpcDialOption := security.LoadClientTLS(util.GetViper(), "grpc.client")
 
+	var clusters []driver.ClusterOptions
+	if opts.clustersConfig != "" {
+		if clusters, err = driver.LoadClusters(opts.clustersConfig); err != nil {
+			return err
+		}
+	}
+
 	identityServer, provisionerServer, err := driver.NewDriver(ctx,
 		opts.driverName,
-		opts.filerEndpoint,
-		opts.endpoint,
-		opts.region,
-		grpcDialOption,
-	)
-	if err != nil {
-		return err
-	}
+		driver.Options{
+			FilerEndpoint:  opts.filerEndpoint,
+			Endpoint:       opts.endpoint,
+			Region:         opts.region,
+			GRPCDialOption: grpcDialOption,
+			IAMBatchWindow: opts.iamBatchWindow,
+			IAMConfigCache: opts.iamConfigCache,
+
+			MasterEndpoint:           opts.masterEndpoint,
+			FilerHealthCheckInterval: opts.filerHealthCheckInterval,
+
+			FilerRetryAttempts:           opts.filerRetryAttempts,
+			FilerRetryBackoff:            opts.filerRetryBackoff,
+			FilerRetryMaxBackoff:         opts.filerRetryMaxBackoff,
+			FilerCircuitBreakerThreshold: opts.filerCircuitBreakerThreshold,
+			FilerCircuitBreakerCooldown:  opts.filerCircuitBreakerCooldown,
+
+			IdentityBackend:    opts.identityBackend,
+			IAMEndpoint:        opts.iamEndpoint,
+			IAMAccessKeyID:     opts.iamAccessKeyID,
+			IAMSecretAccessKey: opts.iamSecretAccessKey,
+
+			IdentityPrefix:          opts.identityPrefix,
+			AdoptExistingIdentities: opts.adoptExistingIdentities,
+
+			KeyRotationOverlap:      opts.keyRotationOverlap,
+			MaxKeyAge:               opts.maxKeyAge,
+			CredentialCheckInterval: opts.credentialCheckInterval,
+			AdminAddress:            opts.adminAddress,
+			AdminTokenFile:          opts.adminTokenFile,
+
+			HealthAddress:       opts.healthAddress,
+			HealthCheckInterval: opts.healthCheckInterval,
+			MetricsAddress:      opts.metricsAddress,
+			StartupCheckTimeout: opts.startupCheckTimeout,
+			StrictFilerVersion:  opts.strictFilerVersion,
+
+			BucketPolicy:      opts.bucketPolicy,
+			S3AccessKeyID:     opts.s3AccessKeyID,
+			S3SecretAccessKey: opts.s3SecretAccessKey,
+
+			AnonymousAccessAllowlist: opts.anonymousAccessAllowlist,
+
+			PathStyle:        opts.pathStyle,
+			CABundleFile:     opts.caBundleFile,
+			SignatureVersion: opts.signatureVersion,
+
+			LeaderElection:         opts.leaderElection,
+			LeaderElectionLease:    opts.leaderElectionLease,
+			LeaderElectionIdentity: opts.leaderElectionIdentity,
 
-	server, err := provisioner.NewDefaultCOSIProvisionerServer(
-		opts.cosiEndpoint,
-		identityServer,
-		provisionerServer,
+			Clusters: clusters,
+		},
 	)
 	if err != nil {
 		return err
 	}
 
-	return server.Run(ctx)
+	return driver.Serve(ctx, opts.cosiEndpoint, identityServer, provisionerServer)
 }
@@ -0,0 +1,191 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/seaweedfs/seaweedfs-cosi-driver/pkg/util/s3client"
+	"github.com/seaweedfs/seaweedfs/weed/s3api/s3_constants"
+)
+
+// actionsParameter is the BucketAccessClass parameter listing the granted S3 actions, separated by commas.
+const actionsParameter = "actions"
+
+// defaultAccessActions are the SeaweedFS actions granted when a BucketAccessClass lists no actions.
+var defaultAccessActions = []string{
+	s3_constants.ACTION_READ,
+	s3_constants.ACTION_WRITE,
+	s3_constants.ACTION_LIST,
+	s3_constants.ACTION_TAGGING,
+}
+
+// s3ActionVerbs maps S3 actions to the SeaweedFS action the S3 gateway checks for them.
+var s3ActionVerbs = map[s3client.Action]string{
+	s3client.GetAccelerateConfiguration:  s3_constants.ACTION_READ,
+	s3client.GetBucketCORS:               s3_constants.ACTION_READ,
+	s3client.GetBucketLocation:           s3_constants.ACTION_READ,
+	s3client.GetBucketLogging:            s3_constants.ACTION_READ,
+	s3client.GetBucketNotification:       s3_constants.ACTION_READ,
+	s3client.GetBucketPolicy:             s3_constants.ACTION_READ,
+	s3client.GetBucketRequestPayment:     s3_constants.ACTION_READ,
+	s3client.GetBucketTagging:            s3_constants.ACTION_READ,
+	s3client.GetBucketVersioning:         s3_constants.ACTION_READ,
+	s3client.GetBucketWebsite:            s3_constants.ACTION_READ,
+	s3client.GetLifecycleConfiguration:   s3_constants.ACTION_READ,
+	s3client.GetObject:                   s3_constants.ACTION_READ,
+	s3client.GetObjectTorrent:            s3_constants.ACTION_READ,
+	s3client.GetObjectVersion:            s3_constants.ACTION_READ,
+	s3client.GetObjectVersionTorrent:     s3_constants.ACTION_READ,
+	s3client.GetReplicationConfiguration: s3_constants.ACTION_READ,
+	s3client.ListBucketMultiPartUploads:  s3_constants.ACTION_READ,
+	s3client.ListMultipartUploadParts:    s3_constants.ACTION_READ,
+
+	s3client.AbortMultipartUpload:           s3_constants.ACTION_WRITE,
+	s3client.DeleteBucketPolicy:             s3_constants.ACTION_WRITE,
+	s3client.DeleteBucketWebsite:            s3_constants.ACTION_WRITE,
+	s3client.DeleteObject:                   s3_constants.ACTION_WRITE,
+	s3client.DeleteObjectVersion:            s3_constants.ACTION_WRITE,
+	s3client.DeleteReplicationConfiguration: s3_constants.ACTION_WRITE,
+	s3client.PutAccelerateConfiguration:     s3_constants.ACTION_WRITE,
+	s3client.PutBucketCORS:                  s3_constants.ACTION_WRITE,
+	s3client.PutBucketLogging:               s3_constants.ACTION_WRITE,
+	s3client.PutBucketNotification:          s3_constants.ACTION_WRITE,
+	s3client.PutBucketPolicy:                s3_constants.ACTION_WRITE,
+	s3client.PutBucketRequestPayment:        s3_constants.ACTION_WRITE,
+	s3client.PutBucketVersioning:            s3_constants.ACTION_WRITE,
+	s3client.PutBucketWebsite:               s3_constants.ACTION_WRITE,
+	s3client.PutLifecycleConfiguration:      s3_constants.ACTION_WRITE,
+	s3client.PutObject:                      s3_constants.ACTION_WRITE,
+	s3client.PutReplicationConfiguration:    s3_constants.ACTION_WRITE,
+	s3client.RestoreObject:                  s3_constants.ACTION_WRITE,
+
+	s3client.ListBucket:         s3_constants.ACTION_LIST,
+	s3client.ListBucketVersions: s3_constants.ACTION_LIST,
+
+	s3client.PutBucketTagging: s3_constants.ACTION_TAGGING,
+
+	s3client.GetBucketAcl:        s3_constants.ACTION_READ_ACP,
+	s3client.GetObjectAcl:        s3_constants.ACTION_READ_ACP,
+	s3client.GetObjectVersionAcl: s3_constants.ACTION_READ_ACP,
+
+	s3client.PutBucketAcl:        s3_constants.ACTION_WRITE_ACP,
+	s3client.PutObjectAcl:        s3_constants.ACTION_WRITE_ACP,
+	s3client.PutObjectVersionAcl: s3_constants.ACTION_WRITE_ACP,
+
+	s3client.DeleteBucket: s3_constants.ACTION_DELETE_BUCKET,
+}
+
+// unsupportedS3Actions are S3 actions SeaweedFS cannot grant on a single bucket, with the reason.
+var unsupportedS3Actions = map[s3client.Action]string{
+	s3client.All:              "it would need the Admin action, which grants full control over the bucket",
+	s3client.CreateBucket:     "it would need the Admin action, which grants full control over the bucket",
+	s3client.ListAllMyBuckets: "listing buckets is not limited to a bucket",
+}
+
+// actionTranslation is the result of translating S3 actions into SeaweedFS actions.
+type actionTranslation struct {
+	// Actions are the SeaweedFS actions to grant.
+	Actions []string
+	// S3Actions are the requested S3 actions with wildcards expanded.
+	S3Actions []s3client.Action
+	// Broadened are the requested S3 actions that SeaweedFS only grants
+	// together with actions that were not requested.
+	Broadened []s3client.Action
+}
+
+// parseActions splits a comma separated list of actions.
+func parseActions(value string) []string {
+	var actions []string
+	for _, action := range strings.Split(value, ",") {
+		if action = strings.TrimSpace(action); action != "" {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// translateS3Actions translates S3 actions like "s3:GetObject" or "s3:Get*" into
+// the closest SeaweedFS actions. Action names are case-insensitive like in IAM.
+// Actions SeaweedFS cannot grant are an error.
+func translateS3Actions(requested []string) (*actionTranslation, error) {
+	known := make([]s3client.Action, 0, len(s3ActionVerbs))
+	for action := range s3ActionVerbs {
+		known = append(known, action)
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i] < known[j] })
+
+	t := &actionTranslation{}
+	for _, r := range requested {
+		r = strings.ToLower(r)
+		for action, reason := range unsupportedS3Actions {
+			if r == strings.ToLower(string(action)) {
+				return nil, fmt.Errorf("action %q cannot be granted: %s", action, reason)
+			}
+		}
+
+		matched := false
+		for _, action := range known {
+			name := strings.ToLower(string(action))
+			if r == name || (strings.HasSuffix(r, "*") && strings.HasPrefix(name, strings.TrimSuffix(r, "*"))) {
+				matched = true
+				if !containsAction(t.S3Actions, action) {
+					t.S3Actions = append(t.S3Actions, action)
+				}
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("action %q cannot be granted by SeaweedFS", r)
+		}
+	}
+
+	for _, action := range t.S3Actions {
+		if verb := s3ActionVerbs[action]; !contains(t.Actions, verb) {
+			t.Actions = append(t.Actions, verb)
+		}
+	}
+	// A SeaweedFS action is exact only if all S3 actions it authorizes were requested
+	for _, verb := range t.Actions {
+		exact := true
+		for _, action := range known {
+			if s3ActionVerbs[action] == verb && !containsAction(t.S3Actions, action) {
+				exact = false
+				break
+			}
+		}
+		if exact {
+			continue
+		}
+		for _, action := range t.S3Actions {
+			if s3ActionVerbs[action] == verb {
+				t.Broadened = append(t.Broadened, action)
+			}
+		}
+	}
+	return t, nil
+}
+
+func containsAction(actions []s3client.Action, action s3client.Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
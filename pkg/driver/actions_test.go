@@ -0,0 +1,145 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/seaweedfs/seaweedfs-cosi-driver/pkg/util/s3client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func Test_translateS3Actions(t *testing.T) {
+	tests := []struct {
+		name          string
+		requested     []string
+		wantActions   []string
+		wantBroadened []s3client.Action
+		wantErr       bool
+	}{
+		{
+			name:          "single action is broadened",
+			requested:     []string{"s3:GetObject"},
+			wantActions:   []string{"Read"},
+			wantBroadened: []s3client.Action{s3client.GetObject},
+		},
+		{
+			name:        "complete list is exact",
+			requested:   []string{"s3:ListBucket", "s3:ListBucketVersions"},
+			wantActions: []string{"List"},
+		},
+		{
+			name:        "names are case-insensitive",
+			requested:   []string{"S3:listbucket", "s3:LISTBUCKETVERSIONS"},
+			wantActions: []string{"List"},
+		},
+		{
+			name:        "wildcard expands",
+			requested:   []string{"s3:List*"},
+			wantActions: []string{"List", "Read"},
+			wantBroadened: []s3client.Action{
+				s3client.ListBucketMultiPartUploads,
+				s3client.ListMultipartUploadParts,
+			},
+		},
+		{
+			name:        "wildcard ignores case",
+			requested:   []string{"s3:listbucket*"},
+			wantActions: []string{"List", "Read"},
+			wantBroadened: []s3client.Action{
+				s3client.ListBucketMultiPartUploads,
+			},
+		},
+		{
+			name:      "everything would need admin",
+			requested: []string{"s3:*", "s3:GetObject"},
+			wantErr:   true,
+		},
+		{
+			name:      "create bucket would need admin",
+			requested: []string{"s3:createbucket"},
+			wantErr:   true,
+		},
+		{
+			name:      "listing all buckets is not limited to the bucket",
+			requested: []string{"s3:ListAllMyBuckets"},
+			wantErr:   true,
+		},
+		{
+			name:      "unknown action",
+			requested: []string{"s3:GetObject", "s3:Fly"},
+			wantErr:   true,
+		},
+		{
+			name:      "wildcard matching nothing",
+			requested: []string{"s3:Fly*"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := translateS3Actions(tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("translateS3Actions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Actions, tt.wantActions) {
+				t.Errorf("translateS3Actions() actions = %v, want %v", got.Actions, tt.wantActions)
+			}
+			if !reflect.DeepEqual(got.Broadened, tt.wantBroadened) {
+				t.Errorf("translateS3Actions() broadened = %v, want %v", got.Broadened, tt.wantBroadened)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_grantS3Actions(t *testing.T) {
+	ctx := context.Background()
+	s := &provisionerServer{
+		provisioner: "provisioner",
+		filerClient: newFakeFiler().client(),
+	}
+	createBuckets(t, s, "bucket")
+
+	_, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{
+		BucketId:   "bucket",
+		Name:       "ba-1",
+		Parameters: map[string]string{"actions": "s3:GetObject, s3:ListBucket"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Read:bucket", "List:bucket"}
+	if identity := findIdentity(t, s, "ba-1"); identity == nil || !reflect.DeepEqual(identity.Actions, want) {
+		t.Errorf("expected actions %v, got %v", want, identity)
+	}
+
+	_, err = s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{
+		BucketId:   "bucket",
+		Name:       "ba-2",
+		Parameters: map[string]string{"actions": "s3:PutObjectRetention"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected unsupported action to be rejected, got %v", err)
+	}
+}
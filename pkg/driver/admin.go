@@ -0,0 +1,158 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// credentialResponse is returned by the admin API for credential requests.
+// The secret key is only known right after a rotation.
+type credentialResponse struct {
+	AccountID       string    `json:"accountId"`
+	AccessKeyID     string    `json:"accessKeyID"`
+	AccessSecretKey string    `json:"accessSecretKey,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// adminHandler returns the HTTP API for administrative tasks like credential rotation.
+func (s *provisionerServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /accounts/{account}/rotate", func(w http.ResponseWriter, r *http.Request) {
+		account := r.PathValue("account")
+		if err := s.compatibility.check(); err != nil {
+			writeCredentialResponse(w, account, nil, "", err)
+			return
+		}
+		cred, secretKey, err := s.rotateCredentials(r.Context(), account)
+		writeCredentialResponse(w, account, cred, secretKey, err)
+	})
+	mux.HandleFunc("GET /accounts/{account}/credentials", func(w http.ResponseWriter, r *http.Request) {
+		account := r.PathValue("account")
+		cred, err := s.activeCredential(r.Context(), account)
+		writeCredentialResponse(w, account, cred, "", err)
+	})
+	return mux
+}
+
+// requireToken only passes on requests carrying the token in the file as bearer
+// token. The file is read for every request, so a rotated Secret takes effect
+// without a restart.
+func requireToken(tokenFile string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := readToken(tokenFile)
+		if err != nil {
+			klog.ErrorS(err, "failed to read admin token")
+			http.Error(w, "admin token unavailable", http.StatusInternalServerError)
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readToken reads a token from the file, refusing empty ones.
+func readToken(tokenFile string) (string, error) {
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", tokenFile)
+	}
+	return token, nil
+}
+
+// isLoopbackAddress checks whether the listen address only accepts local connections.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeCredentialResponse(w http.ResponseWriter, account string, cred *credentialRecord, secretKey string, err error) {
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, ErrAccountNotFound) {
+			code = http.StatusNotFound
+		} else if status.Code(err) == codes.FailedPrecondition {
+			code = http.StatusPreconditionFailed
+		}
+		klog.ErrorS(err, "admin request failed", "account", account)
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(credentialResponse{
+		AccountID:       account,
+		AccessKeyID:     cred.AccessKey,
+		AccessSecretKey: secretKey,
+		CreatedAt:       cred.CreatedAt,
+	})
+}
+
+// serveHTTP serves the handler on the address until the context is cancelled.
+func serveHTTP(ctx context.Context, name, address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		klog.InfoS("serving HTTP", "server", name, "address", listener.Addr().String())
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.ErrorS(err, "HTTP server failed", "server", name)
+		}
+	}()
+	return nil
+}
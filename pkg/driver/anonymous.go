@@ -0,0 +1,112 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"github.com/seaweedfs/seaweedfs/weed/s3api/s3_constants"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// anonymousAccessParameter is the BucketClass parameter granting anonymous users access to the bucket.
+	anonymousAccessParameter = "anonymousAccess"
+	// anonymousAccessRead lets anonymous users read and list the objects of the bucket.
+	anonymousAccessRead = "read"
+)
+
+// anonymousReadActions are granted to the anonymous identity on public-read buckets.
+var anonymousReadActions = []string{
+	s3_constants.ACTION_READ,
+	s3_constants.ACTION_LIST,
+}
+
+// Check whether the bucket matches one of the patterns allowing anonymous access.
+func (s *provisionerServer) anonymousAccessAllowed(bucketName string) bool {
+	for _, pattern := range s.anonymousAllowlist {
+		if matched, err := path.Match(pattern, bucketName); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate the anonymous access requested for the bucket, returning whether it is requested.
+func (s *provisionerServer) checkAnonymousAccess(bucketName, access string) (bool, error) {
+	switch access {
+	case "":
+		return false, nil
+	case anonymousAccessRead:
+	default:
+		return false, fmt.Errorf("unsupported anonymous access %q", access)
+	}
+	if !s.anonymousAccessAllowed(bucketName) {
+		return false, fmt.Errorf("anonymous access is not allowed for bucket %s", bucketName)
+	}
+	if _, ok := s.identityBackend().(*filerIdentityBackend); !ok {
+		return false, fmt.Errorf("anonymous access requires the %s identity backend", IdentityBackendFiler)
+	}
+	return true, nil
+}
+
+// setAnonymousAccess grants or removes read access to the bucket for the anonymous
+// identity. Actions of the anonymous identity on other buckets are left alone.
+func (s *provisionerServer) setAnonymousAccess(ctx context.Context, bucketName string, enabled bool) error {
+	actions := bucketAccessActions(bucketName, "", anonymousReadActions)
+	err := s.updateS3Configuration(ctx, func(s3cfg *iam_pb.S3ApiConfiguration) error {
+		var anonymous *iam_pb.Identity
+		for _, identity := range s3cfg.Identities {
+			if identity.Name == s3_constants.AccountAnonymousId {
+				anonymous = identity
+				break
+			}
+		}
+		if anonymous == nil {
+			if !enabled {
+				return nil
+			}
+			anonymous = &iam_pb.Identity{Name: s3_constants.AccountAnonymousId}
+			s3cfg.Identities = append(s3cfg.Identities, anonymous)
+		}
+
+		if enabled {
+			for _, action := range actions {
+				if !contains(anonymous.Actions, action) {
+					anonymous.Actions = append(anonymous.Actions, action)
+				}
+			}
+			return nil
+		}
+		kept := anonymous.Actions[:0]
+		for _, action := range anonymous.Actions {
+			if !contains(actions, action) {
+				kept = append(kept, action)
+			}
+		}
+		anonymous.Actions = kept
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update anonymous access: %w", err)
+	}
+	klog.InfoS("updated anonymous access", "bucketName", bucketName, "enabled", enabled)
+	return nil
+}
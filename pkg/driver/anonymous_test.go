@@ -0,0 +1,94 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func Test_provisionerServer_anonymousAccess(t *testing.T) {
+	ctx := context.Background()
+	s := &provisionerServer{
+		provisioner:        "provisioner",
+		filerClient:        newFakeFiler().client(),
+		filerBucketsPath:   "/buckets",
+		anonymousAllowlist: []string{"public-*"},
+	}
+	seedIdentities(t, s, &iam_pb.Identity{Name: "anonymous", Actions: []string{"Read:handmade"}})
+
+	public := map[string]string{"anonymousAccess": "read"}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "public-1", Parameters: public}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Read:handmade", "Read:public-1", "List:public-1"}
+	if anonymous := findIdentity(t, s, "anonymous"); !reflect.DeepEqual(anonymous.GetActions(), want) {
+		t.Errorf("expected anonymous actions %v, got %v", want, anonymous)
+	}
+
+	// Buckets outside the allowlist and unknown access levels are refused.
+	for _, req := range []*cosispec.DriverCreateBucketRequest{
+		{Name: "private-1", Parameters: public},
+		{Name: "public-2", Parameters: map[string]string{"anonymousAccess": "write"}},
+	} {
+		if _, err := s.DriverCreateBucket(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected %s to be refused, got %v", req.Name, err)
+		}
+	}
+
+	if _, err := s.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: "public-1"}); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"Read:handmade"}
+	if anonymous := findIdentity(t, s, "anonymous"); !reflect.DeepEqual(anonymous.GetActions(), want) {
+		t.Errorf("expected anonymous access to be removed, got %v", anonymous)
+	}
+}
+
+func Test_provisionerServer_deleteBucketWithoutAnonymousAccess(t *testing.T) {
+	ctx := context.Background()
+	for _, batched := range []bool{false, true} {
+		f := newFakeFiler()
+		s := &provisionerServer{
+			provisioner:      "provisioner",
+			filerClient:      f.client(),
+			filerBucketsPath: "/buckets",
+		}
+		if batched {
+			s.s3ConfigBatcher = newS3ConfigBatcher(0, s.loadS3Configuration, s.storeS3Configuration)
+		}
+		seedIdentities(t, s, &iam_pb.Identity{Name: "anonymous", Actions: []string{"Read:handmade"}})
+		if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "private-1"}); err != nil {
+			t.Fatal(err)
+		}
+		writes := f.writeCount()
+
+		// Deleting a bucket without anonymous access leaves the S3 configuration alone.
+		if _, err := s.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: "private-1"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.writeCount(); got != writes {
+			t.Errorf("batched=%v: expected no writes when deleting a private bucket, got %d", batched, got-writes)
+		}
+	}
+}
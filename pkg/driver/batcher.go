@@ -0,0 +1,173 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/klog/v2"
+)
+
+// s3ConfigBatchTimeout bounds a single read-modify-write of the S3 IAM configuration.
+const s3ConfigBatchTimeout = 30 * time.Second
+
+// s3ConfigMutation is a single change to the S3 IAM configuration waiting to be committed.
+type s3ConfigMutation struct {
+	ctx   context.Context
+	apply func(*iam_pb.S3ApiConfiguration) error
+	done  chan error
+}
+
+// s3ConfigBatcher coalesces changes to the S3 IAM configuration submitted within
+// a short window into a single read-modify-write of the configuration file.
+// Mutations are applied in submission order and each caller gets its own result:
+// a mutation that fails leaves the configuration as it was before it was applied.
+type s3ConfigBatcher struct {
+	window time.Duration
+	load   func(context.Context) (*iam_pb.S3ApiConfiguration, error)
+	save   func(context.Context, *iam_pb.S3ApiConfiguration) error
+
+	mu      sync.Mutex
+	pending []*s3ConfigMutation
+	running bool
+}
+
+func newS3ConfigBatcher(
+	window time.Duration,
+	load func(context.Context) (*iam_pb.S3ApiConfiguration, error),
+	save func(context.Context, *iam_pb.S3ApiConfiguration) error,
+) *s3ConfigBatcher {
+	return &s3ConfigBatcher{
+		window: window,
+		load:   load,
+		save:   save,
+	}
+}
+
+// submit queues the mutation and waits until the batch containing it has been committed.
+// A mutation that is cancelled while still queued is dropped; once its batch has
+// started the result of the commit is awaited, so the caller never reports a
+// failure for a change that was saved.
+func (b *s3ConfigBatcher) submit(ctx context.Context, apply func(*iam_pb.S3ApiConfiguration) error) error {
+	m := &s3ConfigMutation{
+		ctx:   ctx,
+		apply: apply,
+		done:  make(chan error, 1),
+	}
+
+	lockObserved(&b.mu, "iam_config_batch")
+	b.pending = append(b.pending, m)
+	if !b.running {
+		b.running = true
+		go b.run()
+	}
+	b.mu.Unlock()
+
+	select {
+	case err := <-m.done:
+		return err
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	for i, p := range b.pending {
+		if p == m {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			b.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	b.mu.Unlock()
+	return <-m.done
+}
+
+// run commits batches until no more mutations are pending.
+func (b *s3ConfigBatcher) run() {
+	for {
+		if b.window > 0 {
+			time.Sleep(b.window)
+		}
+
+		b.mu.Lock()
+		batch := b.pending
+		b.pending = nil
+		if len(batch) == 0 {
+			b.running = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+
+		b.commit(batch)
+	}
+}
+
+// commit applies all mutations of the batch to a single copy of the configuration
+// and saves it once, unless the mutations left it unchanged.
+func (b *s3ConfigBatcher) commit(batch []*s3ConfigMutation) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(batch[0].ctx), s3ConfigBatchTimeout)
+	defer cancel()
+
+	s3cfg, err := b.load(ctx)
+	if err != nil {
+		for _, m := range batch {
+			m.done <- err
+		}
+		return
+	}
+
+	original := proto.Clone(s3cfg).(*iam_pb.S3ApiConfiguration)
+	applied := make([]*s3ConfigMutation, 0, len(batch))
+	for _, m := range batch {
+		if err := m.ctx.Err(); err != nil {
+			m.done <- err
+			continue
+		}
+
+		snapshot := proto.Clone(s3cfg).(*iam_pb.S3ApiConfiguration)
+		_, span := startSpan(m.ctx, "iam.modify")
+		err := m.apply(s3cfg)
+		endSpan(span, err)
+		if err != nil {
+			s3cfg = snapshot
+			m.done <- err
+			continue
+		}
+		applied = append(applied, m)
+	}
+
+	if len(applied) == 0 {
+		return
+	}
+	if proto.Equal(original, s3cfg) {
+		klog.V(4).InfoS("batched S3 configuration changes left it unchanged", "changes", len(applied))
+		for _, m := range applied {
+			m.done <- nil
+		}
+		return
+	}
+
+	klog.V(4).InfoS("saving batched S3 configuration changes", "changes", len(applied))
+	err = b.save(ctx, s3cfg)
+	for _, m := range applied {
+		m.done <- err
+	}
+}
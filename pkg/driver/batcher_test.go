@@ -0,0 +1,201 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+)
+
+func newBatchedProvisionerServer(f *fakeFiler, window time.Duration) *provisionerServer {
+	s := &provisionerServer{
+		provisioner: "provisioner",
+		filerClient: f.client(),
+	}
+	s.s3ConfigBatcher = newS3ConfigBatcher(window, s.loadS3Configuration, s.storeS3Configuration)
+	return s
+}
+
+func Test_s3ConfigBatcher_coalescesConcurrentChanges(t *testing.T) {
+	f := newFakeFiler()
+	s := newBatchedProvisionerServer(f, 50*time.Millisecond)
+
+	const users = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, users)
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := fmt.Sprintf("user-%d", i)
+			errs <- s.configureS3Access(context.Background(), user, "AK"+user, "SK"+user, []string{"Read:bucket"}, false)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("configureS3Access() error = %v", err)
+		}
+	}
+
+	if writes := f.writeCount(); writes >= users {
+		t.Errorf("expected changes to be coalesced, got %d writes for %d changes", writes, users)
+	}
+
+	s3cfg, err := s.loadS3Configuration(context.Background())
+	if err != nil {
+		t.Fatalf("loadS3Configuration() error = %v", err)
+	}
+	if len(s3cfg.Identities) != users {
+		t.Errorf("expected %d identities, got %d", users, len(s3cfg.Identities))
+	}
+}
+
+func Test_s3ConfigBatcher_failedChangeIsRolledBack(t *testing.T) {
+	f := newFakeFiler()
+	s := newBatchedProvisionerServer(f, 50*time.Millisecond)
+	errBroken := errors.New("broken change")
+
+	var wg sync.WaitGroup
+	var goodErr, badErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		goodErr = s.configureS3Access(context.Background(), "good", "AK", "SK", []string{"Read:bucket"}, false)
+	}()
+	go func() {
+		defer wg.Done()
+		badErr = s.updateS3Configuration(context.Background(), func(s3cfg *iam_pb.S3ApiConfiguration) error {
+			s3cfg.Identities = append(s3cfg.Identities, &iam_pb.Identity{Name: "bad"})
+			return errBroken
+		})
+	}()
+	wg.Wait()
+
+	if goodErr != nil {
+		t.Errorf("expected good change to succeed, got %v", goodErr)
+	}
+	if !errors.Is(badErr, errBroken) {
+		t.Errorf("expected bad change to fail with %v, got %v", errBroken, badErr)
+	}
+
+	s3cfg, err := s.loadS3Configuration(context.Background())
+	if err != nil {
+		t.Fatalf("loadS3Configuration() error = %v", err)
+	}
+	if len(s3cfg.Identities) != 1 || s3cfg.Identities[0].Name != "good" {
+		t.Errorf("expected only the good identity to be saved, got %v", s3cfg.Identities)
+	}
+}
+
+func Test_s3ConfigBatcher_unchangedConfigIsNotSaved(t *testing.T) {
+	f := newFakeFiler()
+	s := newBatchedProvisionerServer(f, 0)
+	if err := s.configureS3Access(context.Background(), "user", "AK", "SK", []string{"Read:bucket"}, false); err != nil {
+		t.Fatalf("configureS3Access() error = %v", err)
+	}
+	writes := f.writeCount()
+
+	// Revoking an unknown user and re-adding known actions change nothing.
+	if err := s.configureS3Access(context.Background(), "unknown", "", "", nil, true); err != nil {
+		t.Fatalf("configureS3Access() error = %v", err)
+	}
+	if err := s.configureS3Access(context.Background(), "user", "", "", []string{"Read:bucket"}, false); err != nil {
+		t.Fatalf("configureS3Access() error = %v", err)
+	}
+	if got := f.writeCount(); got != writes {
+		t.Errorf("expected no writes for changes without effect, got %d", got-writes)
+	}
+}
+
+func Test_s3ConfigBatcher_cancelledWhileQueued(t *testing.T) {
+	f := newFakeFiler()
+	s := newBatchedProvisionerServer(f, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.configureS3Access(ctx, "user", "AK", "SK", []string{"Read:bucket"}, false)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	s.s3ConfigBatcher.mu.Lock()
+	pending := len(s.s3ConfigBatcher.pending)
+	s.s3ConfigBatcher.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("expected the cancelled change to be dequeued, %d still pending", pending)
+	}
+}
+
+// BenchmarkConfigureS3Access compares writing the S3 configuration once per
+// grant with group-committing concurrent grants. The filer write latency is
+// simulated so that concurrent grants queue up like they do against a real filer.
+func BenchmarkConfigureS3Access(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		batched bool
+	}{
+		{name: "per-rpc"},
+		{name: "batched", batched: true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			f := newFakeFiler()
+			f.latency = time.Millisecond
+			s := &provisionerServer{
+				provisioner: "provisioner",
+				filerClient: f.client(),
+			}
+			if bc.batched {
+				s.s3ConfigBatcher = newS3ConfigBatcher(time.Millisecond, s.loadS3Configuration, s.storeS3Configuration)
+			}
+
+			// Unbatched read-modify-writes have to be serialized to not lose updates.
+			var mu sync.Mutex
+			var n atomic.Int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					user := fmt.Sprintf("user-%d", n.Add(1))
+					if !bc.batched {
+						mu.Lock()
+					}
+					err := s.configureS3Access(context.Background(), user, "AK", "SK", []string{"Read:bucket"}, false)
+					if !bc.batched {
+						mu.Unlock()
+					}
+					if err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(f.writeCount())/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// endpointParameter overrides the S3 endpoint advertised for a bucket or bucket access.
+	endpointParameter = "endpoint"
+	// regionParameter overrides the S3 region advertised for a bucket or bucket access.
+	regionParameter = "region"
+
+	// Extended attributes of the bucket entry recording the location chosen when it was created.
+	bucketEndpointAttribute = "cosi-endpoint"
+	bucketRegionAttribute   = "cosi-region"
+)
+
+// s3Location is the S3 endpoint and region advertised to bucket consumers.
+type s3Location struct {
+	Endpoint string
+	Region   string
+}
+
+// withParameters returns the location overridden by the endpoint and region parameters, if given.
+func (l s3Location) withParameters(params map[string]string) (s3Location, error) {
+	if endpoint, ok := params[endpointParameter]; ok {
+		if err := validateEndpoint(endpoint); err != nil {
+			return l, err
+		}
+		l.Endpoint = endpoint
+	}
+	if region, ok := params[regionParameter]; ok {
+		if region == "" {
+			return l, fmt.Errorf("region must not be empty")
+		}
+		l.Region = region
+	}
+	return l, nil
+}
+
+// validateEndpoint checks that an endpoint is an absolute HTTP or HTTPS URL.
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q: expected an http or https URL", endpoint)
+	}
+	return nil
+}
+
+// bucketMetadata returns the extended attributes recording the location, so that
+// it stays the same when the defaults of the driver change later on. Values that
+// are not configured at all are left out.
+func (l s3Location) bucketMetadata() map[string][]byte {
+	extended := map[string][]byte{}
+	if l.Endpoint != "" {
+		extended[bucketEndpointAttribute] = []byte(l.Endpoint)
+	}
+	if l.Region != "" {
+		extended[bucketRegionAttribute] = []byte(l.Region)
+	}
+	return extended
+}
+
+// defaultLocation returns the location configured for the driver.
+func (s *provisionerServer) defaultLocation() s3Location {
+	return s3Location{Endpoint: s.endpoint, Region: s.region}
+}
+
+// bucketLocation returns the location recorded for the bucket when it was created.
+// Buckets created before the location was recorded use the location of the driver,
+// buckets that do not exist are an ErrNotFound.
+func (s *provisionerServer) bucketLocation(ctx context.Context, bucketName string) (s3Location, error) {
+	location := s.defaultLocation()
+	resp, err := s.filerClient.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{
+		Directory: s.filerBucketsPath,
+		Name:      bucketName,
+	})
+	if err == nil && resp.GetEntry() == nil {
+		err = ErrNotFound
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return location, fmt.Errorf("bucket %s: %w", bucketName, ErrNotFound)
+		}
+		return location, fmt.Errorf("failed to look up bucket: %w", err)
+	}
+
+	extended := resp.GetEntry().GetExtended()
+	endpoint, hasEndpoint := extended[bucketEndpointAttribute]
+	region, hasRegion := extended[bucketRegionAttribute]
+	if hasEndpoint {
+		location.Endpoint = string(endpoint)
+	}
+	if hasRegion {
+		location.Region = string(region)
+	}
+	if !hasEndpoint || !hasRegion {
+		klog.V(4).InfoS("bucket has no recorded location, using the defaults",
+			"bucketName", bucketName, "endpoint", location.Endpoint, "region", location.Region)
+	}
+	return location, nil
+}
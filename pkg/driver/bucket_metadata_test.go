@@ -0,0 +1,103 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func Test_provisionerServer_locationOverrides(t *testing.T) {
+	ctx := context.Background()
+	s := newStatefulProvisionerServer()
+	s.endpoint = "https://s3.example.com"
+	s.region = "us-east-1"
+
+	createReqs := []*cosispec.DriverCreateBucketRequest{
+		{Name: "default"},
+		{Name: "internal", Parameters: map[string]string{"endpoint": "http://seaweedfs-s3.seaweedfs:8333"}},
+		{Name: "zoned", Parameters: map[string]string{"endpoint": "https://zone-b.example.com", "region": "zone-b"}},
+	}
+	for _, req := range createReqs {
+		if _, err := s.DriverCreateBucket(ctx, req); err != nil {
+			t.Fatalf("DriverCreateBucket(%s) error = %v", req.Name, err)
+		}
+	}
+	// Buckets created before the driver recorded locations
+	createBuckets(t, s, "legacy")
+
+	tests := []struct {
+		name    string
+		bucket  string
+		params  map[string]string
+		wantLoc s3Location
+		wantErr codes.Code
+	}{
+		{"driver defaults", "default", nil, s3Location{"https://s3.example.com", "us-east-1"}, codes.OK},
+		{"bucket class endpoint", "internal", nil, s3Location{"http://seaweedfs-s3.seaweedfs:8333", "us-east-1"}, codes.OK},
+		{"bucket class endpoint and region", "zoned", nil, s3Location{"https://zone-b.example.com", "zone-b"}, codes.OK},
+		{"access class overrides bucket class", "zoned", map[string]string{"region": "zone-c"}, s3Location{"https://zone-b.example.com", "zone-c"}, codes.OK},
+		{"no recorded location", "legacy", nil, s3Location{"https://s3.example.com", "us-east-1"}, codes.OK},
+		{"unknown bucket", "unknown", nil, s3Location{}, codes.NotFound},
+		{"invalid endpoint", "default", map[string]string{"endpoint": "s3.example.com"}, s3Location{}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{
+				BucketId:   tt.bucket,
+				Name:       "ba-" + tt.bucket,
+				Parameters: tt.params,
+			})
+			if tt.wantErr != codes.OK {
+				if status.Code(err) != tt.wantErr {
+					t.Errorf("expected %v, got %v", tt.wantErr, err)
+				}
+				if identity := findIdentity(t, s, "ba-"+tt.bucket); tt.wantErr == codes.NotFound && identity != nil {
+					t.Errorf("expected no identity to be created, got %v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DriverGrantBucketAccess() error = %v", err)
+			}
+			secrets := resp.Credentials["s3"].Secrets
+			if got := (s3Location{secrets["endpoint"], secrets["region"]}); got != tt.wantLoc {
+				t.Errorf("got location %v, want %v", got, tt.wantLoc)
+			}
+		})
+	}
+
+	// Changing the defaults of the driver does not move existing buckets.
+	s.endpoint, s.region = "https://s3-new.example.com", "eu-west-1"
+	resp, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "default", Name: "ba-pinned"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := resp.Credentials["s3"].Secrets
+	if got, want := (s3Location{secrets["endpoint"], secrets["region"]}), (s3Location{"https://s3.example.com", "us-east-1"}); got != want {
+		t.Errorf("got location %v after changing the defaults, want %v", got, want)
+	}
+
+	_, err = s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "invalid", Parameters: map[string]string{"endpoint": "ftp://s3"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid endpoint of a BucketClass to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/seaweedfs/seaweedfs-cosi-driver/pkg/util/s3client"
+	"k8s.io/klog/v2"
+)
+
+// policySidPrefix precedes the account in the Sid of bucket policy statements maintained by the driver.
+const policySidPrefix = "cosi"
+
+// errCodeNoSuchBucketPolicy is returned by the S3 API for buckets without a policy.
+const errCodeNoSuchBucketPolicy = "NoSuchBucketPolicy"
+
+// policyBucketActions are the bucket-level actions granted to every account.
+var policyBucketActions = []s3client.Action{
+	s3client.GetBucketLocation,
+	s3client.ListBucket,
+	s3client.ListBucketMultiPartUploads,
+	s3client.GetBucketTagging,
+	s3client.PutBucketTagging,
+}
+
+// policyListActions are the bucket-level actions listing keys, which the
+// s3:prefix condition key limits to the keys below a prefix.
+var policyListActions = []s3client.Action{
+	s3client.ListBucket,
+	s3client.ListBucketVersions,
+	s3client.ListBucketMultiPartUploads,
+}
+
+// policySidSuffixes follow the Sid of the account in the Sids of its statements.
+var policySidSuffixes = []string{"Bucket", "List", "Objects"}
+
+// policyObjectActions are the object-level actions granted to every account.
+var policyObjectActions = []s3client.Action{
+	s3client.GetObject,
+	s3client.GetObjectVersion,
+	s3client.PutObject,
+	s3client.DeleteObject,
+	s3client.DeleteObjectVersion,
+	s3client.AbortMultipartUpload,
+	s3client.ListMultipartUploadParts,
+}
+
+// Get the Sid of the bucket policy statements of the account.
+func policySid(account string) string {
+	// Sids may only contain alphanumeric characters, the hash of the account
+	// keeps accounts apart that only differ in other characters
+	sum := sha256.Sum256([]byte(account))
+	return policySidPrefix + strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, account) + hex.EncodeToString(sum[:4])
+}
+
+// bucketPolicyStatements returns the statements granting the account the actions
+// on the bucket, or only on the keys below the prefix if one is given. Listing is
+// then limited to the prefix in a statement of its own, as the condition would
+// deny the other bucket actions. Without actions the default bucket and object
+// actions are granted.
+func bucketPolicyStatements(account, bucketName, prefix string, actions []s3client.Action) []s3client.PolicyStatement {
+	bucketActions, objectActions := policyBucketActions, policyObjectActions
+	if len(actions) > 0 {
+		bucketActions, objectActions = nil, nil
+		for _, action := range actions {
+			if isObjectAction(action) {
+				objectActions = append(objectActions, action)
+			} else {
+				bucketActions = append(bucketActions, action)
+			}
+		}
+	}
+
+	var listActions []s3client.Action
+	if prefix != "" {
+		var otherActions []s3client.Action
+		for _, action := range bucketActions {
+			if containsAction(policyListActions, action) {
+				listActions = append(listActions, action)
+			} else {
+				otherActions = append(otherActions, action)
+			}
+		}
+		bucketActions = otherActions
+	}
+
+	sid := policySid(account)
+	objects := bucketName
+	if prefix != "" {
+		objects = bucketName + "/" + strings.TrimSuffix(prefix, "/")
+	}
+	var statements []s3client.PolicyStatement
+	if len(bucketActions) > 0 {
+		statements = append(statements, *s3client.NewPolicyStatement().
+			WithSID(sid + "Bucket").
+			ForPrincipals(account).
+			Allows().
+			Actions(bucketActions...).
+			ForResources(bucketName))
+	}
+	if len(listActions) > 0 {
+		statements = append(statements, *s3client.NewPolicyStatement().
+			WithSID(sid+"List").
+			ForPrincipals(account).
+			Allows().
+			Actions(listActions...).
+			ForResources(bucketName).
+			WithCondition(s3client.StringLike, "s3:prefix", prefix+"*"))
+	}
+	if len(objectActions) > 0 {
+		statements = append(statements, *s3client.NewPolicyStatement().
+			WithSID(sid + "Objects").
+			ForPrincipals(account).
+			Allows().
+			Actions(objectActions...).
+			ForSubResources(objects))
+	}
+	return statements
+}
+
+// Check whether the action applies to objects rather than to the bucket.
+func isObjectAction(action s3client.Action) bool {
+	return strings.Contains(string(action), "Object") ||
+		action == s3client.AbortMultipartUpload ||
+		action == s3client.ListMultipartUploadParts
+}
+
+// updateBucketPolicy reads the policy of the bucket, lets modify change it and writes it back.
+func (s *provisionerServer) updateBucketPolicy(bucketName string, modify func(*s3client.BucketPolicy)) error {
+	lockObserved(&s.bucketPolicyMu, "bucket_policy")
+	defer s.bucketPolicyMu.Unlock()
+
+	policy, err := s.s3Agent.GetBucketPolicy(bucketName)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == errCodeNoSuchBucketPolicy {
+		policy, err = s3client.NewBucketPolicy(), nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get bucket policy: %w", err)
+	}
+
+	modify(policy)
+
+	if _, err := s.s3Agent.PutBucketPolicy(bucketName, *policy); err != nil {
+		return fmt.Errorf("failed to put bucket policy: %w", err)
+	}
+	return nil
+}
+
+// grantBucketPolicy replaces the statements of the account in the bucket policy.
+func (s *provisionerServer) grantBucketPolicy(account, bucketName, prefix string, actions []s3client.Action) error {
+	statements := bucketPolicyStatements(account, bucketName, prefix, actions)
+	// Statements are replaced in place, only those no longer needed are dropped
+	sid := policySid(account)
+	var obsolete []string
+	for _, suffix := range policySidSuffixes {
+		candidate := sid + suffix
+		needed := false
+		for _, statement := range statements {
+			needed = needed || statement.Sid == candidate
+		}
+		if !needed {
+			obsolete = append(obsolete, candidate)
+		}
+	}
+	err := s.updateBucketPolicy(bucketName, func(policy *s3client.BucketPolicy) {
+		policy.DropPolicyStatements(obsolete...)
+		policy.ModifyBucketPolicy(statements...)
+	})
+	if err == nil {
+		klog.InfoS("granted bucket policy", "bucketName", bucketName, "account", account)
+	}
+	return err
+}
+
+// revokeBucketPolicy drops the statements of the account from the bucket policy.
+func (s *provisionerServer) revokeBucketPolicy(account, bucketName string) error {
+	var sids []string
+	for _, suffix := range policySidSuffixes {
+		sids = append(sids, policySid(account)+suffix)
+	}
+	err := s.updateBucketPolicy(bucketName, func(policy *s3client.BucketPolicy) {
+		policy.DropPolicyStatements(sids...)
+	})
+	if err == nil {
+		klog.InfoS("revoked bucket policy", "bucketName", bucketName, "account", account)
+	}
+	return err
+}
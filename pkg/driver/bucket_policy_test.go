@@ -0,0 +1,222 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/seaweedfs/seaweedfs-cosi-driver/pkg/util/s3client"
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+// fakeS3Client keeps bucket policies in memory.
+type fakeS3Client struct {
+	s3iface.S3API
+
+	mu       sync.Mutex
+	policies map[string]string
+	putErr   error
+}
+
+func newFakeS3Client() *fakeS3Client {
+	return &fakeS3Client{policies: map[string]string{}}
+}
+
+func (c *fakeS3Client) GetBucketPolicy(in *s3.GetBucketPolicyInput) (*s3.GetBucketPolicyOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	policy, ok := c.policies[aws.StringValue(in.Bucket)]
+	if !ok {
+		return nil, awserr.New(errCodeNoSuchBucketPolicy, "no bucket policy", nil)
+	}
+	return &s3.GetBucketPolicyOutput{Policy: aws.String(policy)}, nil
+}
+
+func (c *fakeS3Client) PutBucketPolicy(in *s3.PutBucketPolicyInput) (*s3.PutBucketPolicyOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.putErr != nil {
+		return nil, c.putErr
+	}
+	c.policies[aws.StringValue(in.Bucket)] = aws.StringValue(in.Policy)
+	return &s3.PutBucketPolicyOutput{}, nil
+}
+
+func (c *fakeS3Client) policy(t *testing.T, bucket string) *s3client.BucketPolicy {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	policy := &s3client.BucketPolicy{}
+	if err := json.Unmarshal([]byte(c.policies[bucket]), policy); err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func statementSids(policy *s3client.BucketPolicy) []string {
+	sids := []string{}
+	for _, statement := range policy.Statement {
+		sids = append(sids, statement.Sid)
+	}
+	return sids
+}
+
+func Test_provisionerServer_bucketPolicy(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newFakeS3Client()
+	s := &provisionerServer{
+		provisioner: "provisioner",
+		filerClient: newFakeFiler().client(),
+		s3Agent:     &s3client.S3Agent{Client: s3Client},
+	}
+	createBuckets(t, s, "bucket")
+
+	for _, name := range []string{"ba-1", "ba-2", "ba-1"} {
+		req := &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: name}
+		if name == "ba-2" {
+			req.Parameters = map[string]string{"prefix": "team-b/"}
+		}
+		if _, err := s.DriverGrantBucketAccess(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := s3Client.policy(t, "bucket")
+	if sids := statementSids(policy); len(sids) != 5 || sids[0] != policySid("ba-1")+"Bucket" || sids[3] != policySid("ba-2")+"List" || sids[4] != policySid("ba-2")+"Objects" {
+		t.Fatalf("expected bucket and object statements per account and a list statement for the prefix, got %v", sids)
+	}
+	for _, tc := range []struct {
+		account  string
+		action   s3client.Action
+		resource string
+		prefix   string
+		want     s3client.Decision
+	}{
+		{"ba-1", s3client.GetObject, "arn:aws:s3:::bucket/team-b/a", "", s3client.Allow},
+		{"ba-1", s3client.ListBucket, "arn:aws:s3:::bucket", "", s3client.Allow},
+		{"ba-2", s3client.PutObject, "arn:aws:s3:::bucket/team-b/a", "", s3client.Allow},
+		{"ba-2", s3client.PutObject, "arn:aws:s3:::bucket/team-c/a", "", s3client.ImplicitDeny},
+		{"ba-2", s3client.ListBucket, "arn:aws:s3:::bucket", "team-b/", s3client.Allow},
+		{"ba-2", s3client.ListBucket, "arn:aws:s3:::bucket", "team-b/sub/", s3client.Allow},
+		{"ba-2", s3client.ListBucket, "arn:aws:s3:::bucket", "team-c/", s3client.ImplicitDeny},
+		{"ba-2", s3client.ListBucket, "arn:aws:s3:::bucket", "", s3client.ImplicitDeny},
+		{"ba-2", s3client.GetBucketLocation, "arn:aws:s3:::bucket", "", s3client.Allow},
+		{"ba-3", s3client.GetObject, "arn:aws:s3:::bucket/a", "", s3client.ImplicitDeny},
+	} {
+		req := s3client.EvaluationRequest{Principal: tc.account, Action: tc.action, Resource: tc.resource}
+		if tc.prefix != "" {
+			req.Context = map[string][]string{"s3:prefix": {tc.prefix}}
+		}
+		if got := policy.Evaluate(req); got.Decision != tc.want {
+			t.Errorf("%s %s on %s with prefix %q: got %v, want %v", tc.account, tc.action, tc.resource, tc.prefix, got.Decision, tc.want)
+		}
+	}
+
+	_, err := s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{BucketId: "bucket", AccountId: "ba-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sids := statementSids(s3Client.policy(t, "bucket")); len(sids) != 3 || sids[0] != policySid("ba-2")+"Bucket" {
+		t.Errorf("expected statements of ba-1 to be dropped, got %v", sids)
+	}
+}
+
+func Test_provisionerServer_bucketPolicyKeepsStatements(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newFakeS3Client()
+	s3Client.policies["bucket"] = `{"Version":"2012-10-17","Statement":[{"Sid":"internal","Effect":"Deny","Principal":"*",` +
+		`"Action":"s3:*","Resource":"arn:aws:s3:::bucket/*","Condition":{"NotIpAddress":{"aws:SourceIp":"10.0.0.0/8"}}}]}`
+	s := &provisionerServer{
+		provisioner: "provisioner",
+		filerClient: newFakeFiler().client(),
+		s3Agent:     &s3client.S3Agent{Client: s3Client},
+	}
+	createBuckets(t, s, "bucket")
+
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := s3Client.policy(t, "bucket")
+	got := policy.Evaluate(s3client.EvaluationRequest{
+		Principal: "ba-1",
+		Action:    s3client.GetObject,
+		Resource:  "arn:aws:s3:::bucket/a",
+		Context:   map[string][]string{"aws:SourceIp": {"192.168.0.1"}},
+	})
+	if got.Decision != s3client.Deny || got.Statement.Sid != "internal" {
+		t.Errorf("expected the IP restriction to be kept, got %v %+v", got.Decision, got.Statement)
+	}
+}
+
+func Test_policySid(t *testing.T) {
+	if a, b := policySid("a-b"), policySid("ab"); a == b {
+		t.Errorf("expected accounts differing in special characters to get different Sids, got %s", a)
+	}
+	for _, r := range policySid("ns/ba-1") {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			t.Errorf("expected an alphanumeric Sid, got %s", policySid("ns/ba-1"))
+			break
+		}
+	}
+}
+
+func Test_provisionerServer_bucketPolicyFailureIssuesNoKey(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newFakeS3Client()
+	s3Client.putErr = awserr.New("InternalError", "policy store unavailable", nil)
+	s := &provisionerServer{
+		provisioner: "provisioner",
+		filerClient: newFakeFiler().client(),
+		s3Agent:     &s3client.S3Agent{Client: s3Client},
+	}
+
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"}); err == nil {
+		t.Fatal("expected the grant to fail")
+	}
+	if identity := findIdentity(t, s, "ba-1"); identity != nil {
+		t.Errorf("expected no key to be issued, got %v", identity)
+	}
+}
+
+func Test_provisionerServer_failedGrantDropsBucketPolicy(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newFakeS3Client()
+	s := &provisionerServer{
+		provisioner: "provisioner",
+		filerClient: newFakeFiler().client(),
+		s3Agent:     &s3client.S3Agent{Client: s3Client},
+	}
+	createBuckets(t, s, "bucket")
+	// The identity exists, but was not created by the driver
+	seedIdentities(t, s, &iam_pb.Identity{Name: "ba-1"})
+
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"}); err == nil {
+		t.Fatal("expected the grant to fail")
+	}
+	if sids := statementSids(s3Client.policy(t, "bucket")); len(sids) != 0 {
+		t.Errorf("expected no bucket policy statements after the failed grant, got %v", sids)
+	}
+}
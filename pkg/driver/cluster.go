@@ -0,0 +1,317 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/klog/v2"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+const (
+	// clusterParameter selects the cluster a bucket is created in.
+	clusterParameter = "cluster"
+	// clusterSeparator separates the cluster from the bucket in bucket IDs.
+	clusterSeparator = "/"
+)
+
+// ClusterOptions configures an additional SeaweedFS cluster managed by the driver.
+type ClusterOptions struct {
+	// Name selects the cluster in the cluster parameter of a BucketClass.
+	Name string
+	// FilerEndpoint is the gRPC address of the filer of the cluster, or a
+	// comma-separated list of filers.
+	FilerEndpoint string
+	// MasterEndpoint is the gRPC address of a master to discover filers from, if any.
+	MasterEndpoint string
+	// Endpoint is the S3 endpoint of the cluster handed out to bucket consumers.
+	Endpoint string
+	// Region is the S3 region of the cluster handed out to bucket consumers.
+	Region string
+	// GRPCDialOption is used to connect to the filer and master, the driver-wide option if nil.
+	GRPCDialOption grpc.DialOption
+	// IAMEndpoint is the URL of the IAM API of the cluster, used by IdentityBackendIAM.
+	IAMEndpoint string
+	// IAMAccessKeyID and IAMSecretAccessKey authenticate against the IAM API of the cluster.
+	IAMAccessKeyID     string
+	IAMSecretAccessKey string
+	// S3AccessKeyID and S3SecretAccessKey authenticate against the S3 API of the
+	// cluster to maintain bucket policies.
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	// CABundleFile is the file with the CA bundle handed out to consumers of the cluster, if any.
+	CABundleFile string
+}
+
+// clusterFile is the file format of the cluster configuration.
+type clusterFile struct {
+	Clusters []struct {
+		Name     string `json:"name"`
+		Filer    string `json:"filer"`
+		Master   string `json:"master"`
+		Endpoint string `json:"endpoint"`
+		Region   string `json:"region"`
+		// Credentials of the IAM and S3 APIs, and the CA bundle for consumers
+		IAMEndpoint        string `json:"iamEndpoint"`
+		IAMAccessKeyID     string `json:"iamAccessKeyID"`
+		IAMSecretAccessKey string `json:"iamSecretAccessKey"`
+		S3AccessKeyID      string `json:"s3AccessKeyID"`
+		S3SecretAccessKey  string `json:"s3SecretAccessKey"`
+		CABundleFile       string `json:"caBundleFile"`
+		TLS                *struct {
+			CAFile     string `json:"caFile"`
+			CertFile   string `json:"certFile"`
+			KeyFile    string `json:"keyFile"`
+			ServerName string `json:"serverName"`
+		} `json:"tls"`
+	} `json:"clusters"`
+}
+
+// LoadClusters reads the additional clusters from a JSON file.
+func LoadClusters(path string) ([]ClusterOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster configuration: %w", err)
+	}
+	var file clusterFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse cluster configuration: %w", err)
+	}
+
+	clusters := make([]ClusterOptions, 0, len(file.Clusters))
+	for _, c := range file.Clusters {
+		cluster := ClusterOptions{
+			Name:           c.Name,
+			FilerEndpoint:  c.Filer,
+			MasterEndpoint: c.Master,
+			Endpoint:       c.Endpoint,
+			Region:         c.Region,
+
+			IAMEndpoint:        c.IAMEndpoint,
+			IAMAccessKeyID:     c.IAMAccessKeyID,
+			IAMSecretAccessKey: c.IAMSecretAccessKey,
+			S3AccessKeyID:      c.S3AccessKeyID,
+			S3SecretAccessKey:  c.S3SecretAccessKey,
+			CABundleFile:       c.CABundleFile,
+		}
+		if c.TLS != nil {
+			tlsConfig, err := clusterTLSConfig(c.TLS.CAFile, c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ServerName)
+			if err != nil {
+				return nil, fmt.Errorf("cluster %s: %w", c.Name, err)
+			}
+			cluster.GRPCDialOption = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+func clusterTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// clusterRouter routes COSI calls to the provisioner of the cluster a bucket
+// lives in. Buckets of additional clusters have IDs prefixed with the cluster
+// name, buckets of the default cluster keep their plain names.
+type clusterRouter struct {
+	defaultCluster *provisionerServer
+	clusters       map[string]*provisionerServer
+}
+
+// Interface guards.
+var _ cosispec.ProvisionerServer = &clusterRouter{}
+
+func newClusterRouter(ctx context.Context, provisioner string, opts Options, leader *leaderElector) (*clusterRouter, error) {
+	defaultCluster, err := newProvisionerServer(ctx, provisioner, opts, leader)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &clusterRouter{
+		defaultCluster: defaultCluster,
+		clusters:       map[string]*provisionerServer{},
+	}
+	for _, cluster := range opts.Clusters {
+		if cluster.Name == "" || strings.Contains(cluster.Name, clusterSeparator) {
+			return nil, fmt.Errorf("invalid cluster name %q", cluster.Name)
+		}
+		if _, ok := r.clusters[cluster.Name]; ok {
+			return nil, fmt.Errorf("duplicate cluster %q", cluster.Name)
+		}
+
+		s, err := newProvisionerServer(ctx, provisioner, opts.forCluster(cluster), leader)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %w", cluster.Name, err)
+		}
+		r.clusters[cluster.Name] = s
+	}
+	return r, nil
+}
+
+// forCluster returns the options of an additional cluster. Everything that addresses
+// or authenticates against a cluster, or is handed out to its consumers, comes from
+// the cluster and is never inherited from the default cluster. The admin API is
+// served once for all clusters, below /clusters/<name> for each of them.
+func (opts Options) forCluster(cluster ClusterOptions) Options {
+	clusterOpts := opts
+	clusterOpts.Clusters = nil
+	clusterOpts.cluster = cluster.Name
+	clusterOpts.FilerEndpoint = cluster.FilerEndpoint
+	clusterOpts.MasterEndpoint = cluster.MasterEndpoint
+	clusterOpts.Endpoint = cluster.Endpoint
+	clusterOpts.Region = cluster.Region
+	clusterOpts.IAMEndpoint = cluster.IAMEndpoint
+	clusterOpts.IAMAccessKeyID = cluster.IAMAccessKeyID
+	clusterOpts.IAMSecretAccessKey = cluster.IAMSecretAccessKey
+	clusterOpts.S3AccessKeyID = cluster.S3AccessKeyID
+	clusterOpts.S3SecretAccessKey = cluster.S3SecretAccessKey
+	clusterOpts.CABundleFile = cluster.CABundleFile
+	if cluster.GRPCDialOption != nil {
+		clusterOpts.GRPCDialOption = cluster.GRPCDialOption
+	}
+	return clusterOpts
+}
+
+// Get the provisioner of the named cluster, the default cluster if the name is empty.
+func (r *clusterRouter) cluster(name string) (*provisionerServer, bool) {
+	if name == "" {
+		return r.defaultCluster, true
+	}
+	s, ok := r.clusters[name]
+	return s, ok
+}
+
+// route splits the cluster off the bucket ID and returns its provisioner.
+func (r *clusterRouter) route(bucketID string) (*provisionerServer, string, error) {
+	name, bucket, found := strings.Cut(bucketID, clusterSeparator)
+	if !found {
+		name, bucket = "", bucketID
+	}
+	s, ok := r.cluster(name)
+	if !ok {
+		return nil, "", status.Error(codes.NotFound, fmt.Sprintf("unknown cluster %q in bucket ID %q", name, bucketID))
+	}
+	return s, bucket, nil
+}
+
+// DriverCreateBucket creates the bucket in the cluster selected by the BucketClass.
+func (r *clusterRouter) DriverCreateBucket(
+	ctx context.Context,
+	req *cosispec.DriverCreateBucketRequest,
+) (*cosispec.DriverCreateBucketResponse, error) {
+	name := req.GetParameters()[clusterParameter]
+	s, ok := r.cluster(name)
+	if !ok {
+		klog.ErrorS(nil, "refusing to create bucket in unknown cluster", "name", req.GetName(), "cluster", name)
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown cluster %q", name))
+	}
+
+	resp, err := s.DriverCreateBucket(ctx, req)
+	if err != nil || name == "" {
+		return resp, err
+	}
+	resp.BucketId = name + clusterSeparator + resp.GetBucketId()
+	return resp, nil
+}
+
+// DriverDeleteBucket deletes the bucket in its cluster.
+func (r *clusterRouter) DriverDeleteBucket(
+	ctx context.Context,
+	req *cosispec.DriverDeleteBucketRequest,
+) (*cosispec.DriverDeleteBucketResponse, error) {
+	s, bucket, err := r.route(req.GetBucketId())
+	if err != nil {
+		return nil, err
+	}
+	routed := proto.Clone(req).(*cosispec.DriverDeleteBucketRequest)
+	routed.BucketId = bucket
+	return s.DriverDeleteBucket(ctx, routed)
+}
+
+// DriverGrantBucketAccess grants access to the bucket in its cluster.
+func (r *clusterRouter) DriverGrantBucketAccess(
+	ctx context.Context,
+	req *cosispec.DriverGrantBucketAccessRequest,
+) (*cosispec.DriverGrantBucketAccessResponse, error) {
+	s, bucket, err := r.route(req.GetBucketId())
+	if err != nil {
+		return nil, err
+	}
+	routed := proto.Clone(req).(*cosispec.DriverGrantBucketAccessRequest)
+	routed.BucketId = bucket
+	return s.DriverGrantBucketAccess(ctx, routed)
+}
+
+// DriverRevokeBucketAccess revokes access to the bucket in its cluster.
+func (r *clusterRouter) DriverRevokeBucketAccess(
+	ctx context.Context,
+	req *cosispec.DriverRevokeBucketAccessRequest,
+) (*cosispec.DriverRevokeBucketAccessResponse, error) {
+	s, bucket, err := r.route(req.GetBucketId())
+	if err != nil {
+		return nil, err
+	}
+	routed := proto.Clone(req).(*cosispec.DriverRevokeBucketAccessRequest)
+	routed.BucketId = bucket
+	return s.DriverRevokeBucketAccess(ctx, routed)
+}
+
+// adminHandler serves the admin API of the default cluster at the root and
+// the admin APIs of the additional clusters below /clusters/<name>.
+func (r *clusterRouter) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", r.defaultCluster.adminHandler())
+	for name, s := range r.clusters {
+		prefix := "/clusters/" + name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, s.adminHandler()))
+	}
+	return mux
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func newClusterProvisionerServer(endpoint string) *provisionerServer {
+	s := newStatefulProvisionerServer()
+	s.filerBucketsPath = "/buckets"
+	s.endpoint = endpoint
+	return s
+}
+
+func Test_clusterRouter(t *testing.T) {
+	ctx := context.Background()
+	r := &clusterRouter{
+		defaultCluster: newClusterProvisionerServer("https://s3.example.com"),
+		clusters: map[string]*provisionerServer{
+			"eu": newClusterProvisionerServer("https://s3.eu.example.com"),
+		},
+	}
+
+	tests := []struct {
+		name         string
+		params       map[string]string
+		wantBucketID string
+		wantEndpoint string
+		wantCode     codes.Code
+	}{
+		{"default cluster", nil, "bucket-1", "https://s3.example.com", codes.OK},
+		{"named cluster", map[string]string{"cluster": "eu"}, "eu/bucket-2", "https://s3.eu.example.com", codes.OK},
+		{"unknown cluster", map[string]string{"cluster": "us"}, "", "", codes.InvalidArgument},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("bucket-%d", i+1)
+			created, err := r.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: name, Parameters: tt.params})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("DriverCreateBucket() error = %v, want %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if created.BucketId != tt.wantBucketID {
+				t.Errorf("got bucket ID %q, want %q", created.BucketId, tt.wantBucketID)
+			}
+
+			granted, err := r.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: created.BucketId, Name: "ba-" + name})
+			if err != nil {
+				t.Fatalf("DriverGrantBucketAccess() error = %v", err)
+			}
+			secrets := granted.Credentials["s3"].Secrets
+			if secrets["endpoint"] != tt.wantEndpoint || secrets["bucketName"] != name {
+				t.Errorf("expected access to %s at %s, got %v", name, tt.wantEndpoint, secrets)
+			}
+
+			s, _, _ := r.route(created.BucketId)
+			if identity := findIdentity(t, s, "ba-"+name); identity == nil || !contains(identity.Actions, "Read:"+name) {
+				t.Errorf("expected identity in the cluster of the bucket, got %v", identity)
+			}
+
+			if _, err := r.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{BucketId: created.BucketId, AccountId: granted.AccountId}); err != nil {
+				t.Fatalf("DriverRevokeBucketAccess() error = %v", err)
+			}
+			if identity := findIdentity(t, s, "ba-"+name); identity != nil {
+				t.Errorf("expected identity to be removed, got %v", identity)
+			}
+			if _, err := r.DriverDeleteBucket(ctx, &cosispec.DriverDeleteBucketRequest{BucketId: created.BucketId}); err != nil {
+				t.Fatalf("DriverDeleteBucket() error = %v", err)
+			}
+		})
+	}
+
+	_, err := r.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "us/bucket", Name: "ba"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected bucket of unknown cluster to be not found, got %v", err)
+	}
+}
+
+func Test_clusterRouter_adminHandler(t *testing.T) {
+	ctx := context.Background()
+	eu := newClusterProvisionerServer("")
+	r := &clusterRouter{
+		defaultCluster: newClusterProvisionerServer(""),
+		clusters:       map[string]*provisionerServer{"eu": eu},
+	}
+	if _, err := eu.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]int{
+		"/clusters/eu/accounts/ba-1/credentials": http.StatusOK,
+		"/accounts/ba-1/credentials":             http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		r.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s returned %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestLoadClusters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clusters.json")
+	config := `{"clusters": [
+		{"name": "eu", "filer": "filer.eu:18888", "endpoint": "https://s3.eu.example.com", "region": "eu",
+		 "iamEndpoint": "https://iam.eu.example.com", "s3AccessKeyID": "EUKEY", "caBundleFile": "/etc/eu/ca.crt"},
+		{"name": "us", "filer": "filer.us:18888", "endpoint": "https://s3.us.example.com", "tls": {"serverName": "filer.us"}}
+	]}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := LoadClusters(path)
+	if err != nil {
+		t.Fatalf("LoadClusters() error = %v", err)
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %d", len(clusters))
+	}
+	if c := clusters[0]; c.Name != "eu" || c.FilerEndpoint != "filer.eu:18888" || c.Region != "eu" || c.GRPCDialOption != nil ||
+		c.IAMEndpoint != "https://iam.eu.example.com" || c.S3AccessKeyID != "EUKEY" || c.CABundleFile != "/etc/eu/ca.crt" {
+		t.Errorf("unexpected cluster %+v", c)
+	}
+	if clusters[1].GRPCDialOption == nil {
+		t.Errorf("expected TLS dial option for cluster us")
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"clusters": [{"name": "eu", "tls": {"caFile": "/nonexistent"}}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadClusters(invalid); err == nil {
+		t.Errorf("expected missing CA file to fail")
+	}
+}
+
+func TestOptions_forCluster(t *testing.T) {
+	opts := Options{
+		FilerEndpoint:      "filer:18888",
+		Endpoint:           "https://s3.example.com",
+		IdentityBackend:    IdentityBackendIAM,
+		IAMEndpoint:        "https://iam.example.com",
+		IAMAccessKeyID:     "IAMKEY",
+		IAMSecretAccessKey: "IAMSECRET",
+		S3AccessKeyID:      "S3KEY",
+		S3SecretAccessKey:  "S3SECRET",
+		CABundleFile:       "/etc/ca.crt",
+		AdminAddress:       "127.0.0.1:8090",
+		IdentityPrefix:     "cosi-",
+	}
+	cluster := ClusterOptions{Name: "eu", FilerEndpoint: "filer.eu:18888", Endpoint: "https://s3.eu.example.com", IAMEndpoint: "https://iam.eu.example.com"}
+
+	got := opts.forCluster(cluster)
+	want := Options{
+		FilerEndpoint:   "filer.eu:18888",
+		Endpoint:        "https://s3.eu.example.com",
+		IdentityBackend: IdentityBackendIAM,
+		IAMEndpoint:     "https://iam.eu.example.com",
+		AdminAddress:    "127.0.0.1:8090",
+		IdentityPrefix:  "cosi-",
+		cluster:         "eu",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("forCluster() = %+v, want %+v", got, want)
+	}
+}
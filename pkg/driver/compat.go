@@ -0,0 +1,153 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"github.com/seaweedfs/seaweedfs/weed/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// filerVersion is the SeaweedFS version a filer reports.
+type filerVersion struct {
+	major, minor int32
+}
+
+func (v filerVersion) String() string {
+	return fmt.Sprintf("%d.%02d", v.major, v.minor)
+}
+
+func (v filerVersion) before(other filerVersion) bool {
+	return v.major < other.major || v.major == other.major && v.minor < other.minor
+}
+
+// versionRange is an inclusive range of SeaweedFS versions.
+type versionRange struct {
+	from, to filerVersion
+}
+
+func (r versionRange) contains(v filerVersion) bool {
+	return !v.before(r.from) && !r.to.before(v)
+}
+
+func (r versionRange) String() string {
+	return fmt.Sprintf("%s to %s", r.from, r.to)
+}
+
+// builtVersion is the SeaweedFS version the driver is built against.
+var builtVersion = filerVersion{util.MAJOR_VERSION, util.MINOR_VERSION}
+
+// oldestVersion is the oldest SeaweedFS version the driver supports, the one
+// its filer and IAM protos are pinned to in go.mod. Older filers lack parts
+// of these protos, such as the accounts of identities that mark those managed
+// by the driver, and would silently drop them from identity.json.
+var oldestVersion = filerVersion{3, 71}
+
+// compatibleVersions are the ranges of SeaweedFS versions the driver is known
+// to work with, in ascending order. Within them the location of identity.json,
+// its format as understood by filer.ParseS3ConfigurationFromBytes and the
+// action names match those of builtVersion. Ranges needing different code
+// paths are to be split off here, together with the switch they need.
+var compatibleVersions = []versionRange{
+	{from: oldestVersion, to: builtVersion},
+}
+
+// untestedVersion reports whether the version is newer than the known ranges
+// within the same major version, which is expected to work but was not tested.
+func untestedVersion(v filerVersion) bool {
+	latest := compatibleVersions[len(compatibleVersions)-1].to
+	return v.major == latest.major && latest.before(v)
+}
+
+// checkVersion returns an error for versions the driver must not change
+// identities and buckets with. Untested versions are only refused if strict.
+func checkVersion(v filerVersion, strict bool) error {
+	if v.major == 0 {
+		return fmt.Errorf("filer does not report its SeaweedFS version")
+	}
+	for _, r := range compatibleVersions {
+		if r.contains(v) {
+			return nil
+		}
+	}
+	if untestedVersion(v) && !strict {
+		return nil
+	}
+	ranges := make([]string, 0, len(compatibleVersions))
+	for _, r := range compatibleVersions {
+		ranges = append(ranges, r.String())
+	}
+	return fmt.Errorf("filer runs SeaweedFS %s, the driver supports SeaweedFS %s", v, strings.Join(ranges, ", "))
+}
+
+// filerCompatibility records whether the filer runs a SeaweedFS version the
+// driver may change identities and buckets with. Until the version is known
+// changes are allowed, as they fail at the filer anyway while it is unreachable.
+type filerCompatibility struct {
+	// strict refuses untested versions as well.
+	strict bool
+
+	mu      sync.Mutex
+	version filerVersion
+	err     error
+}
+
+// update records the version of the filer and returns the error changes are refused with, if any.
+func (c *filerCompatibility) update(version filerVersion) error {
+	err := checkVersion(version, c.strict)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version || (err == nil) != (c.err == nil) {
+		switch {
+		case err != nil:
+			klog.ErrorS(err, "refusing to change buckets and identities on an incompatible filer", "version", version)
+		case untestedVersion(version):
+			klog.InfoS("filer runs a SeaweedFS version the driver was not tested with", "version", version, "tested", compatibleVersions[len(compatibleVersions)-1])
+		default:
+			klog.InfoS("filer runs a compatible SeaweedFS version", "version", version)
+		}
+	}
+	c.version, c.err = version, err
+	return err
+}
+
+// check returns a FailedPrecondition error while the filer runs an incompatible version.
+func (c *filerCompatibility) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return status.Error(codes.FailedPrecondition, c.err.Error())
+	}
+	return nil
+}
+
+// checkFilerVersion reads the version of the filer and records whether it is compatible.
+func (s *provisionerServer) checkFilerVersion(ctx context.Context) error {
+	resp, err := s.filerClient.GetFilerConfiguration(ctx, &filer_pb.GetFilerConfigurationRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to read filer configuration: %w", err)
+	}
+	return s.compatibility.update(filerVersion{resp.GetMajorVersion(), resp.GetMinorVersion()})
+}
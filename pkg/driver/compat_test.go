@@ -0,0 +1,110 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func Test_checkVersion(t *testing.T) {
+	newer := filerVersion{builtVersion.major, builtVersion.minor + 1}
+	tests := []struct {
+		name    string
+		version filerVersion
+		strict  bool
+		wantErr bool
+	}{
+		{"built version", builtVersion, true, false},
+		{"oldest supported", filerVersion{3, 71}, true, false},
+		{"before oldest supported", filerVersion{3, 70}, false, true},
+		{"first of major", filerVersion{3, 0}, false, true},
+		{"untested", newer, false, false},
+		{"untested, strict", newer, true, true},
+		{"older major", filerVersion{2, 99}, false, true},
+		{"newer major", filerVersion{builtVersion.major + 1, 0}, false, true},
+		{"unknown", filerVersion{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkVersion(tt.version, tt.strict); (err != nil) != tt.wantErr {
+				t.Errorf("checkVersion(%s) error = %v, wantErr %v", tt.version, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_filerVersionGate(t *testing.T) {
+	ctx := context.Background()
+	filerClient := newFakeFiler().client()
+	s := &provisionerServer{
+		provisioner:      "provisioner",
+		filerClient:      filerClient,
+		filerBucketsPath: "/buckets",
+		state:            newStateStore(filerClient, "provisioner"),
+	}
+	version := filerVersion{builtVersion.major + 1, 0}
+	var configErr error
+	filerClient.getFilerConfigurationFunc = func(ctx context.Context, in *filer_pb.GetFilerConfigurationRequest, opts ...grpc.CallOption) (*filer_pb.GetFilerConfigurationResponse, error) {
+		return &filer_pb.GetFilerConfigurationResponse{MajorVersion: version.major, MinorVersion: version.minor}, configErr
+	}
+
+	// Changes are refused on an incompatible filer
+	if err := s.checkFilerVersion(ctx); err == nil {
+		t.Fatalf("expected filer version check to fail")
+	}
+	_, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition on incompatible filer, got %v", err)
+	}
+	_, err = s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition on incompatible filer, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/accounts/ba/rotate", nil))
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected rotation on incompatible filer to fail with 412, got %d", rec.Code)
+	}
+
+	// An unreachable filer keeps the previous result
+	configErr = errors.New("connection refused")
+	if err := s.checkFilerVersion(ctx); err == nil {
+		t.Errorf("expected filer version check to fail")
+	}
+	if err := s.compatibility.check(); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected filer to stay incompatible, got %v", err)
+	}
+
+	// and changes are accepted again once the filer runs a compatible version
+	version, configErr = builtVersion, nil
+	if err := s.checkFilerVersion(ctx); err != nil {
+		t.Fatalf("checkFilerVersion() error = %v", err)
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket"}); err != nil {
+		t.Errorf("DriverCreateBucket() error = %v", err)
+	}
+}
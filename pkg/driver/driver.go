@@ -20,19 +20,212 @@ package driver
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
 
 	"google.golang.org/grpc"
 	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
 )
 
-func NewDriver(ctx context.Context, provisionerName, filerEndpoint, endpoint, region string, grpcDialOption grpc.DialOption) (cosispec.IdentityServer, cosispec.ProvisionerServer, error) {
-	provisionerServer, err := NewProvisionerServer(provisionerName, filerEndpoint, endpoint, region, grpcDialOption)
+// Options holds the configuration of the driver.
+type Options struct {
+	// FilerEndpoint is the gRPC address of the SeaweedFS filer, or a
+	// comma-separated list of filers to fail over between.
+	FilerEndpoint string
+	// MasterEndpoint is the gRPC address of a SeaweedFS master to discover filers from, if any.
+	MasterEndpoint string
+	// FilerHealthCheckInterval is how often filers are health-checked and discovered.
+	FilerHealthCheckInterval time.Duration
+	// FilerRetryAttempts is how often idempotent filer calls are tried before
+	// a transient failure is returned, at least once.
+	FilerRetryAttempts int
+	// FilerRetryBackoff is the delay before the first retry, doubled for each
+	// further retry up to FilerRetryMaxBackoff.
+	FilerRetryBackoff    time.Duration
+	FilerRetryMaxBackoff time.Duration
+	// FilerCircuitBreakerThreshold is the number of consecutive filer outages
+	// after which filer calls fail fast, zero disables the circuit breaker.
+	FilerCircuitBreakerThreshold int
+	// FilerCircuitBreakerCooldown is how long filer calls fail fast before the filer is tried again.
+	FilerCircuitBreakerCooldown time.Duration
+	// Endpoint is the S3 endpoint advertised to bucket consumers.
+	Endpoint string
+	// Region is the S3 region advertised to bucket consumers.
+	Region string
+	// GRPCDialOption is used when dialing the filer and the master.
+	GRPCDialOption grpc.DialOption
+	// IAMBatchWindow is how long changes to the S3 IAM configuration are
+	// collected before they are written to the filer in a single update.
+	IAMBatchWindow time.Duration
+	// IAMConfigCache enables keeping the S3 IAM configuration in memory,
+	// kept current through a metadata subscription on the filer.
+	IAMConfigCache bool
+	// IdentityBackend selects how identities are managed, either
+	// IdentityBackendFiler (default) or IdentityBackendIAM.
+	IdentityBackend string
+	// IAMEndpoint is the URL of the SeaweedFS IAM API used by IdentityBackendIAM.
+	IAMEndpoint string
+	// IAMAccessKeyID and IAMSecretAccessKey authenticate against the IAM API.
+	IAMAccessKeyID     string
+	IAMSecretAccessKey string
+	// IdentityPrefix is prepended to the names of identities created by the driver.
+	IdentityPrefix string
+	// AdoptExistingIdentities allows the driver to take over identities it did not create.
+	AdoptExistingIdentities bool
+	// KeyRotationOverlap is how long previous credentials stay valid after a rotation.
+	KeyRotationOverlap time.Duration
+	// MaxKeyAge is the age after which credentials are reported as due for rotation, zero disables it.
+	MaxKeyAge time.Duration
+	// CredentialCheckInterval is how often credentials are checked for their age and expiry.
+	CredentialCheckInterval time.Duration
+	// AdminAddress is the address of the admin HTTP API, empty disables it.
+	AdminAddress string
+	// AdminTokenFile is the file with the bearer token required by the admin API,
+	// e.g. mounted from a Secret. Only loopback addresses may do without.
+	AdminTokenFile string
+	// BucketPolicy mirrors every grant in a statement of the bucket policy,
+	// applied through the S3 API at Endpoint.
+	BucketPolicy bool
+	// S3AccessKeyID and S3SecretAccessKey authenticate against the S3 API to maintain bucket policies.
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	// AnonymousAccessAllowlist lists the bucket name patterns, as understood by
+	// path.Match, of buckets BucketClasses may grant anonymous access to.
+	AnonymousAccessAllowlist []string
+	// PathStyle tells bucket consumers to use path-style instead of virtual-hosted-style addressing.
+	PathStyle bool
+	// CABundleFile is the file with the CA bundle handed out to bucket consumers, if any.
+	CABundleFile string
+	// SignatureVersion is the signature version handed out to bucket consumers,
+	// SignatureVersionV4 or SignatureVersionV2.
+	SignatureVersion string
+
+	// HealthAddress is the address of the HTTP /healthz and /readyz probes, disabled if empty.
+	HealthAddress string
+	// HealthCheckInterval is how often the readiness of the driver is checked, every 10 seconds if zero.
+	HealthCheckInterval time.Duration
+
+	// MetricsAddress is the address of the Prometheus metrics endpoint, disabled if empty.
+	MetricsAddress string
+
+	// StartupCheckTimeout limits each check of the filers on startup, zero skips the checks.
+	StartupCheckTimeout time.Duration
+	// StrictFilerVersion refuses changes on filers newer than the SeaweedFS
+	// versions the driver is known to work with, not only on incompatible ones.
+	StrictFilerVersion bool
+
+	// LeaderElection lets replicas of the driver elect a leader through a lock
+	// on the filer, only the leader changes buckets and identities.
+	LeaderElection bool
+	// LeaderElectionLease is how long the leadership lasts without renewal, 15 seconds if zero.
+	LeaderElectionLease time.Duration
+	// LeaderElectionIdentity identifies the replica as lock owner, the host name if empty.
+	LeaderElectionIdentity string
+
+	// Clusters are additional SeaweedFS clusters selected by the cluster parameter
+	// of a BucketClass. Buckets without it are created in the cluster above.
+	Clusters []ClusterOptions
+
+	// cluster is the name of the additional cluster the options are for, empty for the default cluster.
+	cluster string
+}
+
+// driverServer is the provisioner server of one or multiple clusters.
+type driverServer interface {
+	cosispec.ProvisionerServer
+	adminHandler() http.Handler
+	readinessChecks() []readinessCheck
+}
+
+func NewDriver(ctx context.Context, provisionerName string, opts Options) (cosispec.IdentityServer, cosispec.ProvisionerServer, error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var leader *leaderElector
+	if opts.LeaderElection {
+		var err error
+		if leader, err = newDriverLeaderElector(ctx, provisionerName, opts); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var provisionerServer driverServer
+	var err error
+	if len(opts.Clusters) > 0 {
+		provisionerServer, err = newClusterRouter(ctx, provisionerName, opts, leader)
+	} else {
+		provisionerServer, err = newProvisionerServer(ctx, provisionerName, opts, leader)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
+	if opts.StartupCheckTimeout > 0 {
+		if err := checkStartup(ctx, provisionerServer.readinessChecks(), opts.StartupCheckTimeout); err != nil {
+			return nil, nil, err
+		}
+	}
+	if leader != nil {
+		provisionerServer = &leaderServer{driverServer: provisionerServer, leader: leader}
+		go leader.run(ctx)
+	}
+	if opts.AdminAddress != "" {
+		handler := provisionerServer.adminHandler()
+		if opts.AdminTokenFile != "" {
+			handler = requireToken(opts.AdminTokenFile, handler)
+		}
+		if err := serveHTTP(ctx, "admin", opts.AdminAddress, handler); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	readiness := newReadiness(provisionerServer.readinessChecks())
+	interval := opts.HealthCheckInterval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	go readiness.run(ctx, interval)
+	if opts.HealthAddress != "" {
+		if err := serveHTTP(ctx, "health", opts.HealthAddress, readiness.handler()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if opts.MetricsAddress != "" {
+		if err := serveHTTP(ctx, "metrics", opts.MetricsAddress, metricsHandler()); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	identityServer, err := NewIdentityServer(provisionerName)
 	if err != nil {
 		return nil, nil, err
 	}
-	return identityServer, provisionerServer, nil
+	return &identityHealthServer{identityServer, readiness.health}, provisionerServer, nil
+}
+
+// newDriverLeaderElector returns the elector competing for the leadership on the filer of the default cluster.
+func newDriverLeaderElector(ctx context.Context, provisionerName string, opts Options) (*leaderElector, error) {
+	lease := opts.LeaderElectionLease
+	if lease == 0 {
+		lease = defaultLeaderLease
+	}
+	if lease < time.Second {
+		return nil, fmt.Errorf("leader election lease %s is shorter than a second", lease)
+	}
+	identity := opts.LeaderElectionIdentity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine leader election identity: %w", err)
+		}
+		identity = hostname
+	}
+	filerClient, err := createFilerClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newLeaderElector(filerClient, provisionerName, identity, lease), nil
 }
@@ -1,7 +1,150 @@
 package driver
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
 
 var (
 	ErrProvisionerNameEmpty = errors.New("provisioner name cannot be empty")
+	ErrIdentityNotManaged   = errors.New("identity is not managed by this driver")
+	ErrAccountNotFound      = errors.New("account not found")
+)
+
+var (
+	// ErrNotFound means that the filer entry or identity does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists means that the filer entry or identity exists already.
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrUnavailable means that the filer or API could not be reached, retrying may help.
+	ErrUnavailable = errors.New("unavailable")
+	// ErrDeadlineExceeded means that the filer or API did not answer in time, retrying may help.
+	ErrDeadlineExceeded = errors.New("deadline exceeded")
+	// ErrInvalidArgument means that the request can never succeed as it is.
+	ErrInvalidArgument = errors.New("invalid argument")
 )
+
+// Messages by which the filer reports errors that do not carry a gRPC status code.
+const (
+	filerNotFoundMessage      = "no entry is found in filer store"
+	filerAlreadyExistsMessage = "EEXIST"
+)
+
+// classifiedError attaches the class of an error while keeping its message.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+// classifyError marks err with one of ErrNotFound, ErrAlreadyExists,
+// ErrUnavailable, ErrDeadlineExceeded or ErrInvalidArgument, derived from the
+// gRPC status, the AWS error code or the filer message it carries. Errors that
+// fit none of them are returned as they are.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, class := range []error{ErrNotFound, ErrAlreadyExists, ErrUnavailable, ErrDeadlineExceeded, ErrInvalidArgument} {
+		if errors.Is(err, class) {
+			return err
+		}
+	}
+	if class := errorClass(err); class != nil {
+		return &classifiedError{class: class, err: err}
+	}
+	return err
+}
+
+func errorClass(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrDeadlineExceeded
+	case strings.Contains(err.Error(), filerNotFoundMessage):
+		return ErrNotFound
+	case strings.Contains(err.Error(), filerAlreadyExistsMessage):
+		return ErrAlreadyExists
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case iam.ErrCodeNoSuchEntityException, s3.ErrCodeNoSuchBucket, s3.ErrCodeNoSuchKey, errCodeNoSuchBucketPolicy:
+			return ErrNotFound
+		case iam.ErrCodeEntityAlreadyExistsException, s3.ErrCodeBucketAlreadyExists, s3.ErrCodeBucketAlreadyOwnedByYou:
+			return ErrAlreadyExists
+		case iam.ErrCodeMalformedPolicyDocumentException, iam.ErrCodeInvalidInputException, "MalformedPolicy", "InvalidArgument":
+			return ErrInvalidArgument
+		case iam.ErrCodeServiceFailureException, "ServiceUnavailable", "SlowDown", "Throttling", request.ErrCodeRequestError:
+			return ErrUnavailable
+		case request.ErrCodeResponseTimeout:
+			return ErrDeadlineExceeded
+		}
+	}
+
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.NotFound:
+			return ErrNotFound
+		case codes.AlreadyExists:
+			return ErrAlreadyExists
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+			return ErrUnavailable
+		case codes.DeadlineExceeded:
+			return ErrDeadlineExceeded
+		case codes.InvalidArgument:
+			return ErrInvalidArgument
+		}
+	}
+	return nil
+}
+
+// isNotFound reports whether the filer entry or identity does not exist.
+func isNotFound(err error) bool {
+	return errors.Is(classifyError(err), ErrNotFound)
+}
+
+// errorCode returns the gRPC status code an RPC failing with err returns.
+func errorCode(err error) codes.Code {
+	err = classifyError(err)
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrAccountNotFound):
+		return codes.NotFound
+	case errors.Is(err, ErrAlreadyExists):
+		return codes.AlreadyExists
+	case errors.Is(err, ErrUnavailable):
+		return codes.Unavailable
+	case errors.Is(err, ErrDeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, ErrInvalidArgument):
+		return codes.InvalidArgument
+	case errors.Is(err, ErrIdentityNotManaged):
+		return codes.FailedPrecondition
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	default:
+		return codes.Internal
+	}
+}
+
+// rpcError returns the status error an RPC failing with err returns, with the
+// message prefixed by what failed.
+func rpcError(err error, message string) error {
+	return status.Error(errorCode(err), fmt.Sprintf("%s: %s", message, err))
+}
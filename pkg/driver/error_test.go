@@ -0,0 +1,101 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func Test_errorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"filer entry not found", fmt.Errorf("failed to look up bucket: %w", status.Error(codes.Unknown, "filer: no entry is found in filer store")), codes.NotFound},
+		{"filer entry exists", errors.New("EEXIST: entry /buckets/bucket already exists"), codes.AlreadyExists},
+		{"filer unavailable", fmt.Errorf("failed to create bucket in filer: %w", status.Error(codes.Unavailable, "connection refused")), codes.Unavailable},
+		{"filer deadline", status.Error(codes.DeadlineExceeded, "context deadline exceeded"), codes.DeadlineExceeded},
+		{"context deadline", fmt.Errorf("failed to save: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{"context canceled", context.Canceled, codes.Canceled},
+		{"IAM user not found", awserr.New(iam.ErrCodeNoSuchEntityException, "user not found", nil), codes.NotFound},
+		{"IAM user exists", awserr.New(iam.ErrCodeEntityAlreadyExistsException, "user exists", nil), codes.AlreadyExists},
+		{"IAM malformed policy", awserr.New(iam.ErrCodeMalformedPolicyDocumentException, "bad policy", nil), codes.InvalidArgument},
+		{"IAM unreachable", awserr.New("RequestError", "send request failed", nil), codes.Unavailable},
+		{"identity not managed", fmt.Errorf("%w: user", ErrIdentityNotManaged), codes.FailedPrecondition},
+		{"account not found", ErrAccountNotFound, codes.NotFound},
+		{"invalid argument", fmt.Errorf("%w: bad prefix", ErrInvalidArgument), codes.InvalidArgument},
+		{"unknown", errors.New("corrupt configuration"), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.want {
+				t.Errorf("errorCode(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+			if got := status.Code(rpcError(tt.err, "failed")); got != tt.want {
+				t.Errorf("rpcError(%v) returned code %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_errorCodes(t *testing.T) {
+	ctx := context.Background()
+	filerClient := newFakeFiler().client()
+	s := &provisionerServer{
+		provisioner:      "provisioner",
+		filerClient:      filerClient,
+		filerBucketsPath: "/buckets",
+	}
+
+	// Failures the filer reports in the response rather than as an error
+	filerClient.createEntryFunc = func(ctx context.Context, in *filer_pb.CreateEntryRequest, opts ...grpc.CallOption) (*filer_pb.CreateEntryResponse, error) {
+		return &filer_pb.CreateEntryResponse{Error: fmt.Sprintf("EEXIST: entry %s/%s already exists", in.Directory, in.Entry.Name)}, nil
+	}
+	_, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket"})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+
+	filerClient.createEntryFunc = func(ctx context.Context, in *filer_pb.CreateEntryRequest, opts ...grpc.CallOption) (*filer_pb.CreateEntryResponse, error) {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	_, err = s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable, got %v", err)
+	}
+
+	_, err = s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{Name: "ba"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without bucket, got %v", err)
+	}
+	_, err = s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{BucketId: "bucket"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without account, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeFiler is an in-memory filer store backing a mockSeaweedFilerClient.
+type fakeFiler struct {
+	mu      sync.Mutex
+	entries map[string]*filer_pb.Entry
+	writes  int
+	latency time.Duration
+}
+
+func newFakeFiler() *fakeFiler {
+	return &fakeFiler{
+		entries: map[string]*filer_pb.Entry{},
+	}
+}
+
+func (f *fakeFiler) client() *mockSeaweedFilerClient {
+	return &mockSeaweedFilerClient{
+		lookupDirectoryEntryFunc: func(ctx context.Context, in *filer_pb.LookupDirectoryEntryRequest, opts ...grpc.CallOption) (*filer_pb.LookupDirectoryEntryResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			entry, ok := f.entries[path.Join(in.Directory, in.Name)]
+			if !ok {
+				return nil, fmt.Errorf("%s/%s: no entry is found in filer store", in.Directory, in.Name)
+			}
+			return &filer_pb.LookupDirectoryEntryResponse{Entry: proto.Clone(entry).(*filer_pb.Entry)}, nil
+		},
+		createEntryFunc: func(ctx context.Context, in *filer_pb.CreateEntryRequest, opts ...grpc.CallOption) (*filer_pb.CreateEntryResponse, error) {
+			f.write(in.Directory, in.Entry)
+			return &filer_pb.CreateEntryResponse{}, nil
+		},
+		updateEntryFunc: func(ctx context.Context, in *filer_pb.UpdateEntryRequest, opts ...grpc.CallOption) (*filer_pb.UpdateEntryResponse, error) {
+			f.write(in.Directory, in.Entry)
+			return &filer_pb.UpdateEntryResponse{}, nil
+		},
+		getFilerConfigurationFunc: func(ctx context.Context, in *filer_pb.GetFilerConfigurationRequest, opts ...grpc.CallOption) (*filer_pb.GetFilerConfigurationResponse, error) {
+			return &filer_pb.GetFilerConfigurationResponse{MajorVersion: builtVersion.major, MinorVersion: builtVersion.minor}, nil
+		},
+		deleteEntryFunc: func(ctx context.Context, in *filer_pb.DeleteEntryRequest, opts ...grpc.CallOption) (*filer_pb.DeleteEntryResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			delete(f.entries, path.Join(in.Directory, in.Name))
+			return &filer_pb.DeleteEntryResponse{}, nil
+		},
+	}
+}
+
+func (f *fakeFiler) write(dir string, entry *filer_pb.Entry) {
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[path.Join(dir, entry.Name)] = proto.Clone(entry).(*filer_pb.Entry)
+	f.writes++
+}
+
+func (f *fakeFiler) writeCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb"
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"github.com/seaweedfs/seaweedfs/weed/pb/master_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// filerClientType is the cluster node type of filers registered with the master.
+	filerClientType = "filer"
+	// filerPingTimeout limits how long a health check waits for a filer.
+	filerPingTimeout = 5 * time.Second
+)
+
+// filerConn is a connection to one of the filers of a failoverFilerClient.
+type filerConn struct {
+	address string
+	client  filer_pb.SeaweedFilerClient
+	healthy bool
+}
+
+// failoverFilerClient spreads filer calls over several filers. Calls stick to
+// the current filer and fail over to the next healthy one when it becomes
+// unavailable. Filers are health-checked in the background and, with a master,
+// discovered from the cluster.
+type failoverFilerClient struct {
+	dial     func(address string) (filer_pb.SeaweedFilerClient, error)
+	discover func(ctx context.Context) ([]string, error)
+
+	mu      sync.Mutex
+	filers  []*filerConn
+	current int
+}
+
+// Interface guards.
+var _ filer_pb.SeaweedFilerClient = &failoverFilerClient{}
+
+func newFailoverFilerClient(dial func(address string) (filer_pb.SeaweedFilerClient, error)) *failoverFilerClient {
+	return &failoverFilerClient{dial: dial}
+}
+
+// splitFilerAddresses splits a comma-separated list of filer addresses.
+func splitFilerAddresses(addresses string) []string {
+	var result []string
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			result = append(result, address)
+		}
+	}
+	return result
+}
+
+// addFilers connects to the filers not known yet.
+func (c *failoverFilerClient) addFilers(addresses []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, address := range addresses {
+		known := false
+		for _, f := range c.filers {
+			if f.address == address {
+				known = true
+				break
+			}
+		}
+		if known {
+			continue
+		}
+		client, err := c.dial(address)
+		if err != nil {
+			return fmt.Errorf("failed to connect to filer %s: %w", address, err)
+		}
+		c.filers = append(c.filers, &filerConn{address: address, client: client, healthy: true})
+		klog.InfoS("added filer", "address", address)
+	}
+	return nil
+}
+
+// discoverFilers adds the filers registered with the master.
+func (c *failoverFilerClient) discoverFilers(ctx context.Context) error {
+	if c.discover == nil {
+		return nil
+	}
+	addresses, err := c.discover(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to discover filers: %w", err)
+	}
+	return c.addFilers(addresses)
+}
+
+// masterFilerDiscovery returns the gRPC addresses of the filers registered with the master.
+func masterFilerDiscovery(master master_pb.SeaweedClient) func(ctx context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		resp, err := master.ListClusterNodes(ctx, &master_pb.ListClusterNodesRequest{ClientType: filerClientType})
+		if err != nil {
+			return nil, err
+		}
+		addresses := make([]string, 0, len(resp.GetClusterNodes()))
+		for _, node := range resp.GetClusterNodes() {
+			addresses = append(addresses, pb.ServerAddress(node.GetAddress()).ToGrpcAddress())
+		}
+		return addresses, nil
+	}
+}
+
+// candidates returns the filers to try in order: the current one, the other
+// healthy ones and the unhealthy ones as a last resort.
+func (c *failoverFilerClient) candidates() []*filerConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var healthy, unhealthy []*filerConn
+	for i := range c.filers {
+		f := c.filers[(c.current+i)%len(c.filers)]
+		if f.healthy {
+			healthy = append(healthy, f)
+		} else {
+			unhealthy = append(unhealthy, f)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// markHealth records the health of the filer, a healthy filer becomes the
+// current one if the current one is unhealthy.
+func (c *failoverFilerClient) markHealth(filer *filerConn, healthy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if filer.healthy != healthy {
+		klog.InfoS("filer health changed", "address", filer.address, "healthy", healthy)
+	}
+	filer.healthy = healthy
+	if !healthy || c.filers[c.current].healthy {
+		return
+	}
+	for i, f := range c.filers {
+		if f == filer {
+			klog.InfoS("switching to filer", "address", filer.address)
+			c.current = i
+			return
+		}
+	}
+}
+
+// checkHealth pings all filers and updates their health.
+func (c *failoverFilerClient) checkHealth(ctx context.Context) {
+	for _, filer := range c.candidates() {
+		pingCtx, cancel := context.WithTimeout(ctx, filerPingTimeout)
+		_, err := filer.client.Ping(pingCtx, &filer_pb.PingRequest{})
+		cancel()
+		if err != nil {
+			klog.V(4).InfoS("filer health check failed", "address", filer.address, "err", err)
+		}
+		c.markHealth(filer, err == nil)
+	}
+}
+
+// run health-checks and discovers filers periodically until the context is cancelled.
+func (c *failoverFilerClient) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.discoverFilers(ctx); err != nil {
+			klog.ErrorS(err, "failed to refresh filers")
+		}
+		c.checkHealth(ctx)
+	}
+}
+
+// invokeWithFailover calls the current filer and fails over to the others
+// while filers are unavailable.
+func invokeWithFailover[T any](c *failoverFilerClient, call func(filer_pb.SeaweedFilerClient) (T, error)) (T, error) {
+	var (
+		result T
+		err    error
+	)
+	candidates := c.candidates()
+	if len(candidates) == 0 {
+		return result, status.Error(codes.Unavailable, "no filer available")
+	}
+	for _, filer := range candidates {
+		result, err = call(filer.client)
+		if status.Code(err) != codes.Unavailable {
+			c.markHealth(filer, true)
+			return result, err
+		}
+		klog.ErrorS(err, "filer unavailable, failing over", "address", filer.address)
+		c.markHealth(filer, false)
+	}
+	return result, err
+}
+
+// The calls of the filer API. Streaming calls fail over when the stream
+// cannot be opened, but not once it is established.
+
+func (c *failoverFilerClient) LookupDirectoryEntry(ctx context.Context, in *filer_pb.LookupDirectoryEntryRequest, opts ...grpc.CallOption) (*filer_pb.LookupDirectoryEntryResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.LookupDirectoryEntryResponse, error) {
+		return client.LookupDirectoryEntry(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) ListEntries(ctx context.Context, in *filer_pb.ListEntriesRequest, opts ...grpc.CallOption) (filer_pb.SeaweedFiler_ListEntriesClient, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (filer_pb.SeaweedFiler_ListEntriesClient, error) {
+		return client.ListEntries(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) CreateEntry(ctx context.Context, in *filer_pb.CreateEntryRequest, opts ...grpc.CallOption) (*filer_pb.CreateEntryResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.CreateEntryResponse, error) {
+		return client.CreateEntry(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) UpdateEntry(ctx context.Context, in *filer_pb.UpdateEntryRequest, opts ...grpc.CallOption) (*filer_pb.UpdateEntryResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.UpdateEntryResponse, error) {
+		return client.UpdateEntry(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) AppendToEntry(ctx context.Context, in *filer_pb.AppendToEntryRequest, opts ...grpc.CallOption) (*filer_pb.AppendToEntryResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.AppendToEntryResponse, error) {
+		return client.AppendToEntry(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) DeleteEntry(ctx context.Context, in *filer_pb.DeleteEntryRequest, opts ...grpc.CallOption) (*filer_pb.DeleteEntryResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.DeleteEntryResponse, error) {
+		return client.DeleteEntry(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) AtomicRenameEntry(ctx context.Context, in *filer_pb.AtomicRenameEntryRequest, opts ...grpc.CallOption) (*filer_pb.AtomicRenameEntryResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.AtomicRenameEntryResponse, error) {
+		return client.AtomicRenameEntry(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) StreamRenameEntry(ctx context.Context, in *filer_pb.StreamRenameEntryRequest, opts ...grpc.CallOption) (filer_pb.SeaweedFiler_StreamRenameEntryClient, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (filer_pb.SeaweedFiler_StreamRenameEntryClient, error) {
+		return client.StreamRenameEntry(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) AssignVolume(ctx context.Context, in *filer_pb.AssignVolumeRequest, opts ...grpc.CallOption) (*filer_pb.AssignVolumeResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.AssignVolumeResponse, error) {
+		return client.AssignVolume(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) LookupVolume(ctx context.Context, in *filer_pb.LookupVolumeRequest, opts ...grpc.CallOption) (*filer_pb.LookupVolumeResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.LookupVolumeResponse, error) {
+		return client.LookupVolume(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) CollectionList(ctx context.Context, in *filer_pb.CollectionListRequest, opts ...grpc.CallOption) (*filer_pb.CollectionListResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.CollectionListResponse, error) {
+		return client.CollectionList(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) DeleteCollection(ctx context.Context, in *filer_pb.DeleteCollectionRequest, opts ...grpc.CallOption) (*filer_pb.DeleteCollectionResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.DeleteCollectionResponse, error) {
+		return client.DeleteCollection(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) Statistics(ctx context.Context, in *filer_pb.StatisticsRequest, opts ...grpc.CallOption) (*filer_pb.StatisticsResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.StatisticsResponse, error) {
+		return client.Statistics(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) Ping(ctx context.Context, in *filer_pb.PingRequest, opts ...grpc.CallOption) (*filer_pb.PingResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.PingResponse, error) {
+		return client.Ping(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) GetFilerConfiguration(ctx context.Context, in *filer_pb.GetFilerConfigurationRequest, opts ...grpc.CallOption) (*filer_pb.GetFilerConfigurationResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.GetFilerConfigurationResponse, error) {
+		return client.GetFilerConfiguration(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) TraverseBfsMetadata(ctx context.Context, in *filer_pb.TraverseBfsMetadataRequest, opts ...grpc.CallOption) (filer_pb.SeaweedFiler_TraverseBfsMetadataClient, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (filer_pb.SeaweedFiler_TraverseBfsMetadataClient, error) {
+		return client.TraverseBfsMetadata(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) SubscribeMetadata(ctx context.Context, in *filer_pb.SubscribeMetadataRequest, opts ...grpc.CallOption) (filer_pb.SeaweedFiler_SubscribeMetadataClient, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (filer_pb.SeaweedFiler_SubscribeMetadataClient, error) {
+		return client.SubscribeMetadata(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) SubscribeLocalMetadata(ctx context.Context, in *filer_pb.SubscribeMetadataRequest, opts ...grpc.CallOption) (filer_pb.SeaweedFiler_SubscribeLocalMetadataClient, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (filer_pb.SeaweedFiler_SubscribeLocalMetadataClient, error) {
+		return client.SubscribeLocalMetadata(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) KvGet(ctx context.Context, in *filer_pb.KvGetRequest, opts ...grpc.CallOption) (*filer_pb.KvGetResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.KvGetResponse, error) {
+		return client.KvGet(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) KvPut(ctx context.Context, in *filer_pb.KvPutRequest, opts ...grpc.CallOption) (*filer_pb.KvPutResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.KvPutResponse, error) {
+		return client.KvPut(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) CacheRemoteObjectToLocalCluster(ctx context.Context, in *filer_pb.CacheRemoteObjectToLocalClusterRequest, opts ...grpc.CallOption) (*filer_pb.CacheRemoteObjectToLocalClusterResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.CacheRemoteObjectToLocalClusterResponse, error) {
+		return client.CacheRemoteObjectToLocalCluster(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) DistributedLock(ctx context.Context, in *filer_pb.LockRequest, opts ...grpc.CallOption) (*filer_pb.LockResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.LockResponse, error) {
+		return client.DistributedLock(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) DistributedUnlock(ctx context.Context, in *filer_pb.UnlockRequest, opts ...grpc.CallOption) (*filer_pb.UnlockResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.UnlockResponse, error) {
+		return client.DistributedUnlock(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) FindLockOwner(ctx context.Context, in *filer_pb.FindLockOwnerRequest, opts ...grpc.CallOption) (*filer_pb.FindLockOwnerResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.FindLockOwnerResponse, error) {
+		return client.FindLockOwner(ctx, in, opts...)
+	})
+}
+
+func (c *failoverFilerClient) TransferLocks(ctx context.Context, in *filer_pb.TransferLocksRequest, opts ...grpc.CallOption) (*filer_pb.TransferLocksResponse, error) {
+	return invokeWithFailover(c, func(client filer_pb.SeaweedFilerClient) (*filer_pb.TransferLocksResponse, error) {
+		return client.TransferLocks(ctx, in, opts...)
+	})
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeFilerPool hands out filer clients that fail with Unavailable while their filer is down.
+type fakeFilerPool struct {
+	mu    sync.Mutex
+	down  map[string]bool
+	calls []string
+}
+
+func (p *fakeFilerPool) setDown(address string, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[address] = down
+}
+
+func (p *fakeFilerPool) called() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	calls := p.calls
+	p.calls = nil
+	return calls
+}
+
+func (p *fakeFilerPool) dial(address string) (filer_pb.SeaweedFilerClient, error) {
+	call := func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.calls = append(p.calls, address)
+		if p.down[address] {
+			return status.Error(codes.Unavailable, "connection refused")
+		}
+		return nil
+	}
+	return &mockSeaweedFilerClient{
+		lookupDirectoryEntryFunc: func(ctx context.Context, in *filer_pb.LookupDirectoryEntryRequest, opts ...grpc.CallOption) (*filer_pb.LookupDirectoryEntryResponse, error) {
+			if err := call(); err != nil {
+				return nil, err
+			}
+			return &filer_pb.LookupDirectoryEntryResponse{}, nil
+		},
+		pingFunc: func(ctx context.Context, in *filer_pb.PingRequest, opts ...grpc.CallOption) (*filer_pb.PingResponse, error) {
+			if err := call(); err != nil {
+				return nil, err
+			}
+			return &filer_pb.PingResponse{}, nil
+		},
+	}, nil
+}
+
+func Test_failoverFilerClient(t *testing.T) {
+	ctx := context.Background()
+	pool := &fakeFilerPool{down: map[string]bool{}}
+	c := newFailoverFilerClient(pool.dial)
+	if err := c.addFilers(splitFilerAddresses("filer-a:18888, filer-b:18888,")); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func() error {
+		_, err := c.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{})
+		return err
+	}
+
+	if err := lookup(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := pool.called(); !reflect.DeepEqual(calls, []string{"filer-a:18888"}) {
+		t.Errorf("expected calls to go to the first filer, got %v", calls)
+	}
+
+	// Fail over once the current filer is unavailable, and stick to the new one.
+	pool.setDown("filer-a:18888", true)
+	if err := lookup(); err != nil {
+		t.Fatalf("expected failover, got %v", err)
+	}
+	pool.setDown("filer-a:18888", false)
+	if err := lookup(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := pool.called(); !reflect.DeepEqual(calls, []string{"filer-a:18888", "filer-b:18888", "filer-b:18888"}) {
+		t.Errorf("expected failover to the second filer, got %v", calls)
+	}
+
+	// Health checks switch away from an unhealthy current filer.
+	pool.setDown("filer-b:18888", true)
+	c.checkHealth(ctx)
+	pool.called()
+	if err := lookup(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := pool.called(); !reflect.DeepEqual(calls, []string{"filer-a:18888"}) {
+		t.Errorf("expected health check to switch back to the first filer, got %v", calls)
+	}
+
+	pool.setDown("filer-a:18888", true)
+	if err := lookup(); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable with all filers down, got %v", err)
+	}
+}
+
+func Test_failoverFilerClient_discoverFilers(t *testing.T) {
+	ctx := context.Background()
+	pool := &fakeFilerPool{down: map[string]bool{}}
+	c := newFailoverFilerClient(pool.dial)
+	if _, err := c.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable without filers, got %v", err)
+	}
+
+	discovered := []string{"filer-a:18888"}
+	c.discover = func(ctx context.Context) ([]string, error) {
+		return discovered, nil
+	}
+	if err := c.discoverFilers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	discovered = append(discovered, "filer-b:18888")
+	if err := c.discoverFilers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.filers) != 2 {
+		t.Errorf("expected both discovered filers to be added once, got %d", len(c.filers))
+	}
+
+	c.discover = func(ctx context.Context) ([]string, error) {
+		return nil, errors.New("master unavailable")
+	}
+	if err := c.discoverFilers(ctx); err == nil {
+		t.Errorf("expected discovery error")
+	}
+}
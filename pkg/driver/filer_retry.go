@@ -0,0 +1,253 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// retryPolicy is how often and how long apart failed filer calls are retried.
+type retryPolicy struct {
+	// attempts is the number of times a call is tried, at least once.
+	attempts int
+	// backoff is the delay before the first retry, doubled for each further one.
+	backoff time.Duration
+	// maxBackoff caps the delay between retries.
+	maxBackoff time.Duration
+}
+
+// delay returns the delay before the retry following the attempt, with jitter
+// spreading the retries of concurrent calls over the upper half of the backoff.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff
+	for i := 0; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if p.maxBackoff > 0 && d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// circuitBreaker stops calls to the filers after consecutive outages. Once it
+// opened, calls fail fast until the cooldown passed, then a single call probes
+// whether the filers are back.
+type circuitBreaker struct {
+	// threshold is the number of consecutive outages opening the breaker, zero disables it.
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow returns an Unavailable error while the breaker is open.
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return status.Error(codes.Unavailable, "filer circuit breaker is open")
+	}
+	b.probing = true
+	return nil
+}
+
+// record counts the result of a call, only outages of the filers count as
+// failures. Calls that ran out of time or were cancelled by their caller
+// say nothing about the filers and are not counted either way.
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if !isFilerOutage(err) {
+		if b.failures >= b.threshold {
+			klog.InfoS("filer circuit breaker closed")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			klog.ErrorS(err, "filer circuit breaker opened", "cooldown", b.cooldown)
+		}
+		b.openedAt = b.now()
+	}
+}
+
+// isFilerOutage reports whether the filers could not be reached or turned the
+// call down for lack of resources. gRPC reports transport failures as
+// Unavailable. Deadlines and cancellations are left out, they are set by the
+// callers and a few slow calls must not fail the calls of everyone else.
+func isFilerOutage(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// resilientFilerClient retries idempotent filer calls failing with transient
+// errors and guards the entry, key-value and lock calls with a circuit breaker.
+// The remaining calls, health checks and streams pass through.
+type resilientFilerClient struct {
+	filer_pb.SeaweedFilerClient
+	retry   retryPolicy
+	breaker *circuitBreaker
+}
+
+// Interface guards.
+var _ filer_pb.SeaweedFilerClient = &resilientFilerClient{}
+
+func newResilientFilerClient(client filer_pb.SeaweedFilerClient, retry retryPolicy, breaker *circuitBreaker) *resilientFilerClient {
+	return &resilientFilerClient{SeaweedFilerClient: client, retry: retry, breaker: breaker}
+}
+
+// invokeResilient calls the filer through the circuit breaker and, if the call
+// is idempotent, retries it while the filer is unavailable, the attempts are
+// not used up and the context leaves time for the next one.
+func invokeResilient[T any](ctx context.Context, c *resilientFilerClient, method string, idempotent bool, call func() (T, error)) (T, error) {
+	var (
+		result T
+		err    error
+	)
+	for attempt := 0; ; attempt++ {
+		if err = c.breaker.allow(); err != nil {
+			filerCircuitRejections.Inc()
+			return result, err
+		}
+		result, err = call()
+		c.breaker.record(ctx, err)
+		if err == nil || !idempotent || attempt+1 >= c.retry.attempts || !errors.Is(classifyError(err), ErrUnavailable) {
+			return result, err
+		}
+
+		delay := c.retry.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return result, err
+		}
+		klog.V(4).InfoS("retrying filer call", "method", method, "attempt", attempt+1, "delay", delay, "err", err)
+		filerRetries.WithLabelValues(method).Inc()
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *resilientFilerClient) LookupDirectoryEntry(ctx context.Context, in *filer_pb.LookupDirectoryEntryRequest, opts ...grpc.CallOption) (*filer_pb.LookupDirectoryEntryResponse, error) {
+	return invokeResilient(ctx, c, "LookupDirectoryEntry", true, func() (*filer_pb.LookupDirectoryEntryResponse, error) {
+		return c.SeaweedFilerClient.LookupDirectoryEntry(ctx, in, opts...)
+	})
+}
+
+// CreateEntry overwrites existing entries unless OExcl is set, only then it is not idempotent.
+func (c *resilientFilerClient) CreateEntry(ctx context.Context, in *filer_pb.CreateEntryRequest, opts ...grpc.CallOption) (*filer_pb.CreateEntryResponse, error) {
+	return invokeResilient(ctx, c, "CreateEntry", !in.GetOExcl(), func() (*filer_pb.CreateEntryResponse, error) {
+		return c.SeaweedFilerClient.CreateEntry(ctx, in, opts...)
+	})
+}
+
+func (c *resilientFilerClient) UpdateEntry(ctx context.Context, in *filer_pb.UpdateEntryRequest, opts ...grpc.CallOption) (*filer_pb.UpdateEntryResponse, error) {
+	return invokeResilient(ctx, c, "UpdateEntry", true, func() (*filer_pb.UpdateEntryResponse, error) {
+		return c.SeaweedFilerClient.UpdateEntry(ctx, in, opts...)
+	})
+}
+
+func (c *resilientFilerClient) AppendToEntry(ctx context.Context, in *filer_pb.AppendToEntryRequest, opts ...grpc.CallOption) (*filer_pb.AppendToEntryResponse, error) {
+	return invokeResilient(ctx, c, "AppendToEntry", false, func() (*filer_pb.AppendToEntryResponse, error) {
+		return c.SeaweedFilerClient.AppendToEntry(ctx, in, opts...)
+	})
+}
+
+// DeleteEntry succeeds for entries that do not exist, which makes it idempotent.
+func (c *resilientFilerClient) DeleteEntry(ctx context.Context, in *filer_pb.DeleteEntryRequest, opts ...grpc.CallOption) (*filer_pb.DeleteEntryResponse, error) {
+	return invokeResilient(ctx, c, "DeleteEntry", true, func() (*filer_pb.DeleteEntryResponse, error) {
+		return c.SeaweedFilerClient.DeleteEntry(ctx, in, opts...)
+	})
+}
+
+func (c *resilientFilerClient) AtomicRenameEntry(ctx context.Context, in *filer_pb.AtomicRenameEntryRequest, opts ...grpc.CallOption) (*filer_pb.AtomicRenameEntryResponse, error) {
+	return invokeResilient(ctx, c, "AtomicRenameEntry", false, func() (*filer_pb.AtomicRenameEntryResponse, error) {
+		return c.SeaweedFilerClient.AtomicRenameEntry(ctx, in, opts...)
+	})
+}
+
+func (c *resilientFilerClient) KvGet(ctx context.Context, in *filer_pb.KvGetRequest, opts ...grpc.CallOption) (*filer_pb.KvGetResponse, error) {
+	return invokeResilient(ctx, c, "KvGet", true, func() (*filer_pb.KvGetResponse, error) {
+		return c.SeaweedFilerClient.KvGet(ctx, in, opts...)
+	})
+}
+
+func (c *resilientFilerClient) KvPut(ctx context.Context, in *filer_pb.KvPutRequest, opts ...grpc.CallOption) (*filer_pb.KvPutResponse, error) {
+	return invokeResilient(ctx, c, "KvPut", true, func() (*filer_pb.KvPutResponse, error) {
+		return c.SeaweedFilerClient.KvPut(ctx, in, opts...)
+	})
+}
+
+func (c *resilientFilerClient) DistributedLock(ctx context.Context, in *filer_pb.LockRequest, opts ...grpc.CallOption) (*filer_pb.LockResponse, error) {
+	return invokeResilient(ctx, c, "DistributedLock", false, func() (*filer_pb.LockResponse, error) {
+		return c.SeaweedFilerClient.DistributedLock(ctx, in, opts...)
+	})
+}
+
+func (c *resilientFilerClient) DistributedUnlock(ctx context.Context, in *filer_pb.UnlockRequest, opts ...grpc.CallOption) (*filer_pb.UnlockResponse, error) {
+	return invokeResilient(ctx, c, "DistributedUnlock", false, func() (*filer_pb.UnlockResponse, error) {
+		return c.SeaweedFilerClient.DistributedUnlock(ctx, in, opts...)
+	})
+}
+
+func (c *resilientFilerClient) FindLockOwner(ctx context.Context, in *filer_pb.FindLockOwnerRequest, opts ...grpc.CallOption) (*filer_pb.FindLockOwnerResponse, error) {
+	return invokeResilient(ctx, c, "FindLockOwner", true, func() (*filer_pb.FindLockOwnerResponse, error) {
+		return c.SeaweedFilerClient.FindLockOwner(ctx, in, opts...)
+	})
+}
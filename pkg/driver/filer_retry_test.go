@@ -0,0 +1,281 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+// faultyFilerClient injects Unavailable errors into the entry calls of a fake filer.
+type faultyFilerClient struct {
+	filer_pb.SeaweedFilerClient
+
+	mu    sync.Mutex
+	fail  int
+	down  bool
+	err   error
+	calls int
+}
+
+// failNext makes the next n calls fail.
+func (c *faultyFilerClient) failNext(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail = n
+}
+
+// setDown makes all calls fail until the filer is up again.
+func (c *faultyFilerClient) setDown(down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = down
+}
+
+// failWith makes all calls fail with err until it is nil again.
+func (c *faultyFilerClient) failWith(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+func (c *faultyFilerClient) called() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := c.calls
+	c.calls = 0
+	return calls
+}
+
+func (c *faultyFilerClient) fault() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return c.err
+	}
+	if c.down {
+		return status.Error(codes.Unavailable, "filer is down")
+	}
+	if c.fail > 0 {
+		c.fail--
+		return status.Error(codes.Unavailable, "filer is restarting")
+	}
+	return nil
+}
+
+func (c *faultyFilerClient) LookupDirectoryEntry(ctx context.Context, in *filer_pb.LookupDirectoryEntryRequest, opts ...grpc.CallOption) (*filer_pb.LookupDirectoryEntryResponse, error) {
+	if err := c.fault(); err != nil {
+		return nil, err
+	}
+	return c.SeaweedFilerClient.LookupDirectoryEntry(ctx, in, opts...)
+}
+
+func (c *faultyFilerClient) CreateEntry(ctx context.Context, in *filer_pb.CreateEntryRequest, opts ...grpc.CallOption) (*filer_pb.CreateEntryResponse, error) {
+	if err := c.fault(); err != nil {
+		return nil, err
+	}
+	return c.SeaweedFilerClient.CreateEntry(ctx, in, opts...)
+}
+
+func (c *faultyFilerClient) UpdateEntry(ctx context.Context, in *filer_pb.UpdateEntryRequest, opts ...grpc.CallOption) (*filer_pb.UpdateEntryResponse, error) {
+	if err := c.fault(); err != nil {
+		return nil, err
+	}
+	return c.SeaweedFilerClient.UpdateEntry(ctx, in, opts...)
+}
+
+func newFaultyFilerClient() *faultyFilerClient {
+	return &faultyFilerClient{SeaweedFilerClient: newFakeFiler().client()}
+}
+
+func Test_resilientFilerClient_retry(t *testing.T) {
+	ctx := context.Background()
+	filer := newFaultyFilerClient()
+	c := newResilientFilerClient(filer, retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: 5 * time.Millisecond}, newCircuitBreaker(0, 0))
+	lookup := &filer_pb.LookupDirectoryEntryRequest{Directory: "/buckets", Name: "bucket"}
+
+	// Lookups are retried until they succeed
+	filer.failNext(2)
+	if _, err := c.LookupDirectoryEntry(ctx, lookup); !isNotFound(err) {
+		t.Errorf("expected lookup to reach the filer, got %v", err)
+	}
+	if calls := filer.called(); calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+
+	// but not beyond the attempts
+	filer.failNext(3)
+	if _, err := c.LookupDirectoryEntry(ctx, lookup); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable, got %v", err)
+	}
+	if calls := filer.called(); calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+
+	// Exclusive creates are not idempotent
+	filer.failNext(1)
+	create := &filer_pb.CreateEntryRequest{Directory: "/buckets", Entry: &filer_pb.Entry{Name: "bucket"}, OExcl: true}
+	if _, err := c.CreateEntry(ctx, create); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable, got %v", err)
+	}
+	if calls := filer.called(); calls != 1 {
+		t.Errorf("expected exclusive create not to be retried, got %d calls", calls)
+	}
+
+	// Permanent errors are not retried
+	if _, err := c.LookupDirectoryEntry(ctx, lookup); !isNotFound(err) {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	if calls := filer.called(); calls != 1 {
+		t.Errorf("expected NotFound not to be retried, got %d calls", calls)
+	}
+
+	// Retries stay within the deadline
+	c.retry = retryPolicy{attempts: 3, backoff: time.Minute, maxBackoff: time.Minute}
+	deadlineCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	filer.failNext(1)
+	if _, err := c.LookupDirectoryEntry(deadlineCtx, lookup); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable, got %v", err)
+	}
+	if calls := filer.called(); calls != 1 {
+		t.Errorf("expected no retry past the deadline, got %d calls", calls)
+	}
+}
+
+func Test_retryPolicy_delay(t *testing.T) {
+	p := retryPolicy{attempts: 10, backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if d := p.delay(attempt); d < want/2 || d > want {
+			t.Errorf("delay(%d) = %v, want between %v and %v", attempt, d, want/2, want)
+		}
+	}
+}
+
+func Test_circuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	breaker := newCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+	filer := newFaultyFilerClient()
+	c := newResilientFilerClient(filer, retryPolicy{attempts: 1}, breaker)
+	lookup := func() error {
+		_, err := c.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{Directory: "/", Name: "buckets"})
+		return err
+	}
+
+	// The breaker opens after consecutive outages and fails fast
+	filer.setDown(true)
+	for i := 0; i < 3; i++ {
+		if err := lookup(); status.Code(err) != codes.Unavailable {
+			t.Errorf("expected Unavailable, got %v", err)
+		}
+	}
+	if calls := filer.called(); calls != 2 {
+		t.Errorf("expected the open breaker to fail fast, got %d calls", calls)
+	}
+
+	// A failed probe after the cooldown keeps it open
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if err := lookup(); status.Code(err) != codes.Unavailable {
+			t.Errorf("expected Unavailable, got %v", err)
+		}
+	}
+	if calls := filer.called(); calls != 1 {
+		t.Errorf("expected a single probe, got %d calls", calls)
+	}
+
+	// A successful probe closes it again
+	filer.setDown(false)
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if err := lookup(); !isNotFound(err) {
+			t.Errorf("expected lookup to reach the filer, got %v", err)
+		}
+	}
+	if calls := filer.called(); calls != 2 {
+		t.Errorf("expected the closed breaker to pass calls, got %d calls", calls)
+	}
+}
+
+func Test_circuitBreaker_outages(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, tc := range []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		wantOpen bool
+	}{
+		{name: "unavailable", ctx: context.Background(), err: status.Error(codes.Unavailable, "connection refused"), wantOpen: true},
+		{name: "resource exhausted", ctx: context.Background(), err: status.Error(codes.ResourceExhausted, "too many requests"), wantOpen: true},
+		{name: "deadline exceeded", ctx: context.Background(), err: status.Error(codes.DeadlineExceeded, "context deadline exceeded")},
+		{name: "canceled", ctx: context.Background(), err: status.Error(codes.Canceled, "context canceled")},
+		{name: "cancelled caller", ctx: cancelled, err: status.Error(codes.Unavailable, "connection closed")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filer := newFaultyFilerClient()
+			c := newResilientFilerClient(filer, retryPolicy{attempts: 1}, newCircuitBreaker(2, time.Minute))
+			filer.failWith(tc.err)
+			for i := 0; i < 3; i++ {
+				_, _ = c.LookupDirectoryEntry(tc.ctx, &filer_pb.LookupDirectoryEntryRequest{Directory: "/", Name: "buckets"})
+			}
+
+			filer.failWith(nil)
+			filer.called()
+			_, err := c.LookupDirectoryEntry(context.Background(), &filer_pb.LookupDirectoryEntryRequest{Directory: "/", Name: "buckets"})
+			if open := filer.called() == 0; open != tc.wantOpen {
+				t.Errorf("breaker open = %v, want %v, last error %v", open, tc.wantOpen, err)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_filerRestart(t *testing.T) {
+	ctx := context.Background()
+	filer := newFaultyFilerClient()
+	s := &provisionerServer{
+		provisioner:      "provisioner",
+		filerClient:      newResilientFilerClient(filer, retryPolicy{attempts: 5, backoff: time.Millisecond, maxBackoff: 5 * time.Millisecond}, newCircuitBreaker(5, time.Minute)),
+		filerBucketsPath: "/buckets",
+	}
+
+	filer.failNext(2)
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket"}); err != nil {
+		t.Fatalf("DriverCreateBucket() error = %v", err)
+	}
+	filer.failNext(2)
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba"}); err != nil {
+		t.Fatalf("DriverGrantBucketAccess() error = %v", err)
+	}
+
+	filer.setDown(true)
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-2"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable while the filer is down, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// readinessTimeout limits how long a single readiness check may take.
+	readinessTimeout = 5 * time.Second
+	// defaultHealthCheckInterval is how often the readiness is checked by default.
+	defaultHealthCheckInterval = 10 * time.Second
+)
+
+// readinessCheck is a named check that has to pass for the driver to be ready.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readinessChecks returns the checks of the connection to the filer and its
+// version, the access to the identities and the existence of the buckets directory.
+func (s *provisionerServer) readinessChecks() []readinessCheck {
+	return []readinessCheck{
+		{"filer", func(ctx context.Context) error {
+			_, err := s.filerClient.Ping(ctx, &filer_pb.PingRequest{})
+			return err
+		}},
+		{"filer version", s.checkFilerVersion},
+		{"identities", func(ctx context.Context) error {
+			return s.identityBackend().checkAccess(ctx)
+		}},
+		{"buckets", func(ctx context.Context) error {
+			dir, name := path.Split(s.filerBucketsPath)
+			resp, err := s.filerClient.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{
+				Directory: dir,
+				Name:      name,
+			})
+			if err != nil {
+				return err
+			}
+			if !resp.GetEntry().GetIsDirectory() {
+				return fmt.Errorf("%s is not a directory", s.filerBucketsPath)
+			}
+			return nil
+		}},
+	}
+}
+
+// readinessChecks returns the checks of all clusters.
+func (r *clusterRouter) readinessChecks() []readinessCheck {
+	checks := r.defaultCluster.readinessChecks()
+	for name, s := range r.clusters {
+		for _, c := range s.readinessChecks() {
+			checks = append(checks, readinessCheck{name + "/" + c.name, c.check})
+		}
+	}
+	return checks
+}
+
+// readiness periodically runs the readiness checks and reports the result
+// through the gRPC health service and the HTTP probes.
+type readiness struct {
+	checks []readinessCheck
+	health *health.Server
+
+	mu       sync.Mutex
+	failures map[string]error
+	checked  bool
+}
+
+func newReadiness(checks []readinessCheck) *readiness {
+	r := &readiness{
+		checks: checks,
+		health: health.NewServer(),
+	}
+	r.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return r
+}
+
+// check runs all checks and updates the serving status.
+func (r *readiness) check(ctx context.Context) {
+	failures := map[string]error{}
+	for _, c := range r.checks {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		if err := c.check(checkCtx); err != nil {
+			failures[c.name] = err
+		}
+		cancel()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(failures) > 0 {
+		for name, err := range failures {
+			if _, failed := r.failures[name]; !failed {
+				klog.ErrorS(err, "readiness check failed", "check", name)
+			}
+		}
+		r.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	} else {
+		if len(r.failures) > 0 || !r.checked {
+			klog.InfoS("driver is ready")
+		}
+		r.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}
+	r.failures = failures
+	r.checked = true
+}
+
+// ready reports whether the driver is ready and which checks failed.
+func (r *readiness) ready() (bool, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.checked {
+		return false, []string{"readiness not checked yet"}
+	}
+	var failures []string
+	for name, err := range r.failures {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+	}
+	sort.Strings(failures)
+	return len(failures) == 0, failures
+}
+
+// run checks the readiness right away and then periodically until the context is cancelled.
+func (r *readiness) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.check(ctx)
+		select {
+		case <-ctx.Done():
+			r.health.Shutdown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handler serves /healthz, which succeeds while the driver is running, and
+// /readyz, which fails while a readiness check fails.
+func (r *readiness) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		ready, failures := r.ready()
+		if !ready {
+			http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func Test_readiness(t *testing.T) {
+	ctx := context.Background()
+	filer := newFakeFiler()
+	client := filer.client()
+	pingErr := errors.New("connection refused")
+	client.pingFunc = func(ctx context.Context, in *filer_pb.PingRequest, opts ...grpc.CallOption) (*filer_pb.PingResponse, error) {
+		return nil, pingErr
+	}
+	s := &provisionerServer{
+		provisioner:      "provisioner",
+		filerClient:      client,
+		filerBucketsPath: "/buckets",
+	}
+	r := newReadiness(s.readinessChecks())
+
+	probe := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		r.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+	servingStatus := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := r.health.Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+
+	if code, _ := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready before the first check, got %d", code)
+	}
+	if code, _ := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("expected healthz to succeed, got %d", code)
+	}
+
+	r.check(ctx)
+	code, body := probe("/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "filer: connection refused") || !strings.Contains(body, "buckets:") {
+		t.Errorf("expected filer and buckets checks to fail, got %d: %s", code, body)
+	}
+	if status := servingStatus(); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expected NOT_SERVING, got %v", status)
+	}
+
+	pingErr = nil
+	filer.write("/", &filer_pb.Entry{Name: "buckets", IsDirectory: true})
+	r.check(ctx)
+	if code, body := probe("/readyz"); code != http.StatusOK {
+		t.Errorf("expected ready, got %d: %s", code, body)
+	}
+	if status := servingStatus(); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("expected SERVING, got %v", status)
+	}
+}
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	identityServer, err := NewIdentityServer("provisioner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReadiness(nil)
+	r.check(ctx)
+
+	socket := filepath.Join(t.TempDir(), "cosi.sock")
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, "unix://"+socket, &identityHealthServer{identityServer, r.health}, &provisionerServer{})
+	}()
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	callCtx, callCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer callCancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(callCtx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("health Check() = %v, %v, want SERVING", resp, err)
+	}
+	info, err := cosispec.NewIdentityClient(conn).DriverGetInfo(callCtx, &cosispec.DriverGetInfoRequest{})
+	if err != nil || info.Name != "provisioner" {
+		t.Errorf("DriverGetInfo() = %v, %v", info, err)
+	}
+
+	cancel()
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve() error = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,382 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"github.com/seaweedfs/seaweedfs/weed/s3api/s3_constants"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// iamPolicyName is the name of the inline user policy holding the granted actions.
+	iamPolicyName = "cosi-bucket-access"
+	// iamPolicyVersion is the version of the IAM policy document format.
+	iamPolicyVersion = "2012-10-17"
+	// iamDefaultRegion is used for signing IAM requests when no region is configured.
+	iamDefaultRegion = "us-east-1"
+)
+
+// iamStatementActions maps SeaweedFS identity actions to the policy actions
+// understood by the SeaweedFS IAM API.
+var iamStatementActions = map[string]string{
+	s3_constants.ACTION_ADMIN:         "*",
+	s3_constants.ACTION_READ:          "Get*",
+	s3_constants.ACTION_READ_ACP:      "GetBucketAcl",
+	s3_constants.ACTION_WRITE:         "Put*",
+	s3_constants.ACTION_WRITE_ACP:     "PutBucketAcl",
+	s3_constants.ACTION_LIST:          "List*",
+	s3_constants.ACTION_TAGGING:       "Tagging*",
+	s3_constants.ACTION_DELETE_BUCKET: "DeleteBucket*",
+}
+
+type iamPolicyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+type iamPolicyDocument struct {
+	Version   string               `json:"Version"`
+	Statement []iamPolicyStatement `json:"Statement"`
+}
+
+// iamIdentityBackend manages identities through the IAM-compatible API of SeaweedFS,
+// so the driver keeps working regardless of where SeaweedFS stores its identities.
+// The IAM API has no way to mark users, so the users created by the driver are
+// recorded in its state and no other user is modified unless adoption is allowed.
+type iamIdentityBackend struct {
+	client          iamiface.IAMAPI
+	state           *stateStore
+	adoptIdentities bool
+}
+
+// Interface guards.
+var _ identityBackend = &iamIdentityBackend{}
+
+// Create a new IAM API client for the SeaweedFS IAM endpoint.
+func createIAMClient(endpoint, accessKey, secretKey, region string) (iamiface.IAMAPI, error) {
+	if region == "" {
+		region = iamDefaultRegion
+	}
+	sess, err := session.NewSession(
+		aws.NewConfig().
+			WithRegion(region).
+			WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")).
+			WithEndpoint(endpoint).
+			WithMaxRetries(5).
+			WithHTTPClient(&http.Client{
+				Timeout: time.Second * 15,
+			}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IAM session: %w", err)
+	}
+	return iam.New(sess), nil
+}
+
+func newIAMIdentityBackend(client iamiface.IAMAPI, state *stateStore, adoptIdentities bool) *iamIdentityBackend {
+	return &iamIdentityBackend{
+		client:          client,
+		state:           state,
+		adoptIdentities: adoptIdentities,
+	}
+}
+
+func (b *iamIdentityBackend) grantAccess(ctx context.Context, user string, actions []string) (*iam_pb.Credential, error) {
+	if err := b.grantActions(ctx, user, actions); err != nil {
+		return nil, err
+	}
+
+	out, err := b.client.CreateAccessKeyWithContext(ctx, &iam.CreateAccessKeyInput{UserName: aws.String(user)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IAM access key: %w", err)
+	}
+
+	return &iam_pb.Credential{
+		AccessKey: aws.StringValue(out.AccessKey.AccessKeyId),
+		SecretKey: aws.StringValue(out.AccessKey.SecretAccessKey),
+	}, nil
+}
+
+func (b *iamIdentityBackend) grantActions(ctx context.Context, user string, actions []string) error {
+	_, err := b.client.GetUserWithContext(ctx, &iam.GetUserInput{UserName: aws.String(user)})
+	if isIAMNoSuchEntity(err) {
+		// Record the user first, a user created but not recorded could never be granted again
+		if err := b.claimUser(ctx, user, false); err != nil {
+			return err
+		}
+		_, err = b.client.CreateUserWithContext(ctx, &iam.CreateUserInput{UserName: aws.String(user)})
+	} else if err == nil {
+		err = b.claimUser(ctx, user, true)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to ensure IAM user: %w", err)
+	}
+
+	// SeaweedFS replaces all actions of the user on PutUserPolicy, so merge them first.
+	current, err := b.userActions(ctx, user)
+	if err != nil {
+		return err
+	}
+	merged := append([]string{}, current...)
+	for _, action := range actions {
+		if !contains(merged, action) {
+			merged = append(merged, action)
+		}
+	}
+	if len(merged) != len(current) {
+		return b.putUserActions(ctx, user, merged)
+	}
+	return nil
+}
+
+func (b *iamIdentityBackend) revokeAccess(ctx context.Context, user string) error {
+	managed, err := b.isManagedUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !managed {
+		_, err := b.client.GetUserWithContext(ctx, &iam.GetUserInput{UserName: aws.String(user)})
+		if isIAMNoSuchEntity(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get IAM user: %w", err)
+		}
+		if !b.adoptIdentities {
+			return fmt.Errorf("%w: %s", ErrIdentityNotManaged, user)
+		}
+	}
+
+	keys, err := b.client.ListAccessKeysWithContext(ctx, &iam.ListAccessKeysInput{UserName: aws.String(user)})
+	if err != nil && !isIAMNoSuchEntity(err) {
+		return fmt.Errorf("failed to list IAM access keys: %w", err)
+	}
+	if keys != nil {
+		for _, key := range keys.AccessKeyMetadata {
+			_, err := b.client.DeleteAccessKeyWithContext(ctx, &iam.DeleteAccessKeyInput{
+				UserName:    aws.String(user),
+				AccessKeyId: key.AccessKeyId,
+			})
+			if err != nil && !isIAMNoSuchEntity(err) {
+				return fmt.Errorf("failed to delete IAM access key: %w", err)
+			}
+		}
+	}
+
+	_, err = b.client.DeleteUserPolicyWithContext(ctx, &iam.DeleteUserPolicyInput{
+		UserName:   aws.String(user),
+		PolicyName: aws.String(iamPolicyName),
+	})
+	if err != nil && !isIAMNoSuchEntity(err) {
+		return fmt.Errorf("failed to delete IAM user policy: %w", err)
+	}
+
+	_, err = b.client.DeleteUserWithContext(ctx, &iam.DeleteUserInput{UserName: aws.String(user)})
+	if err != nil && !isIAMNoSuchEntity(err) {
+		return fmt.Errorf("failed to delete IAM user: %w", err)
+	}
+
+	if !managed {
+		return nil
+	}
+	return b.state.update(ctx, func(state *driverState) error {
+		delete(state.IAMUsers, user)
+		return nil
+	})
+}
+
+func (b *iamIdentityBackend) deleteCredential(ctx context.Context, user, accessKey string) error {
+	managed, err := b.isManagedUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !managed && !b.adoptIdentities {
+		return fmt.Errorf("%w: %s", ErrIdentityNotManaged, user)
+	}
+
+	_, err = b.client.DeleteAccessKeyWithContext(ctx, &iam.DeleteAccessKeyInput{
+		UserName:    aws.String(user),
+		AccessKeyId: aws.String(accessKey),
+	})
+	if err != nil && !isIAMNoSuchEntity(err) {
+		return fmt.Errorf("failed to delete IAM access key: %w", err)
+	}
+	return nil
+}
+
+func (b *iamIdentityBackend) checkAccess(ctx context.Context) error {
+	if _, err := b.client.ListUsersWithContext(ctx, &iam.ListUsersInput{MaxItems: aws.Int64(1)}); err != nil {
+		return fmt.Errorf("failed to list IAM users: %w", err)
+	}
+	return nil
+}
+
+// isManagedUser checks whether the driver created or adopted the IAM user.
+func (b *iamIdentityBackend) isManagedUser(ctx context.Context, user string) (bool, error) {
+	var managed bool
+	err := b.state.view(ctx, func(state *driverState) {
+		managed = state.IAMUsers[user]
+	})
+	return managed, err
+}
+
+// claimUser makes sure the driver may modify the IAM user, recording it as managed.
+// Existing users that are not recorded yet are only adopted if that is allowed.
+func (b *iamIdentityBackend) claimUser(ctx context.Context, user string, exists bool) error {
+	managed, err := b.isManagedUser(ctx, user)
+	if err != nil || managed {
+		return err
+	}
+	if exists && !b.adoptIdentities {
+		return fmt.Errorf("%w: %s", ErrIdentityNotManaged, user)
+	}
+
+	if exists {
+		klog.InfoS("adopting existing IAM user", "user", user)
+	}
+	return b.state.update(ctx, func(state *driverState) error {
+		state.IAMUsers[user] = true
+		return nil
+	})
+}
+
+// userActions returns the SeaweedFS actions granted to the user by its inline policy.
+func (b *iamIdentityBackend) userActions(ctx context.Context, user string) ([]string, error) {
+	out, err := b.client.GetUserPolicyWithContext(ctx, &iam.GetUserPolicyInput{
+		UserName:   aws.String(user),
+		PolicyName: aws.String(iamPolicyName),
+	})
+	if isIAMNoSuchEntity(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IAM user policy: %w", err)
+	}
+
+	var doc iamPolicyDocument
+	if err := json.Unmarshal([]byte(aws.StringValue(out.PolicyDocument)), &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse IAM user policy: %w", err)
+	}
+	return actionsFromPolicyDocument(doc), nil
+}
+
+func (b *iamIdentityBackend) putUserActions(ctx context.Context, user string, actions []string) error {
+	doc, err := policyDocumentFromActions(actions)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to serialize IAM user policy: %w", err)
+	}
+
+	_, err = b.client.PutUserPolicyWithContext(ctx, &iam.PutUserPolicyInput{
+		UserName:       aws.String(user),
+		PolicyName:     aws.String(iamPolicyName),
+		PolicyDocument: aws.String(string(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put IAM user policy: %w", err)
+	}
+	return nil
+}
+
+// policyDocumentFromActions converts SeaweedFS actions like "Read:bucket" into
+// a policy document with one statement per resource.
+func policyDocumentFromActions(actions []string) (iamPolicyDocument, error) {
+	doc := iamPolicyDocument{Version: iamPolicyVersion}
+	statements := map[string]int{}
+	for _, action := range actions {
+		verb, bucket, scoped := strings.Cut(action, ":")
+		statementAction, ok := iamStatementActions[verb]
+		if !ok {
+			return doc, fmt.Errorf("action %q is not supported by the IAM API", action)
+		}
+
+		resource := "*"
+		if scoped && strings.Contains(bucket, "/") {
+			// The IAM API of SeaweedFS only understands whole-bucket resources
+			return doc, fmt.Errorf("prefix-scoped action %q is not supported by the IAM API", action)
+		}
+		if scoped {
+			resource = fmt.Sprintf("arn:aws:s3:::%s/*", bucket)
+		}
+		i, ok := statements[resource]
+		if !ok {
+			i = len(doc.Statement)
+			statements[resource] = i
+			doc.Statement = append(doc.Statement, iamPolicyStatement{
+				Effect:   "Allow",
+				Resource: []string{resource},
+			})
+		}
+		doc.Statement[i].Action = append(doc.Statement[i].Action, "s3:"+statementAction)
+	}
+	return doc, nil
+}
+
+// actionsFromPolicyDocument converts a policy document returned by the IAM API back into SeaweedFS actions.
+func actionsFromPolicyDocument(doc iamPolicyDocument) []string {
+	var actions []string
+	for _, statement := range doc.Statement {
+		if statement.Effect != "Allow" {
+			continue
+		}
+		for _, resource := range statement.Resource {
+			bucket := ""
+			if resource != "*" {
+				bucket = strings.TrimSuffix(strings.TrimPrefix(resource, "arn:aws:s3:::"), "/*")
+			}
+			for _, statementAction := range statement.Action {
+				for verb, a := range iamStatementActions {
+					if "s3:"+a != statementAction {
+						continue
+					}
+					action := verb
+					if bucket != "" {
+						action = fmt.Sprintf("%s:%s", verb, bucket)
+					}
+					if !contains(actions, action) {
+						actions = append(actions, action)
+					}
+				}
+			}
+		}
+	}
+	return actions
+}
+
+func isIAMNoSuchEntity(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException
+}
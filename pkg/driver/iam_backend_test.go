@@ -0,0 +1,238 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+type fakeIAMUser struct {
+	keys   []string
+	policy string
+}
+
+// fakeIAMClient mimics the subset of the SeaweedFS IAM API used by the driver.
+type fakeIAMClient struct {
+	iamiface.IAMAPI
+	users map[string]*fakeIAMUser
+	keyID int
+}
+
+func newFakeIAMClient() *fakeIAMClient {
+	return &fakeIAMClient{users: map[string]*fakeIAMUser{}}
+}
+
+func errNoSuchEntity() error {
+	return awserr.New(iam.ErrCodeNoSuchEntityException, "no such entity", nil)
+}
+
+func (c *fakeIAMClient) GetUserWithContext(_ aws.Context, in *iam.GetUserInput, _ ...request.Option) (*iam.GetUserOutput, error) {
+	if _, ok := c.users[*in.UserName]; !ok {
+		return nil, errNoSuchEntity()
+	}
+	return &iam.GetUserOutput{User: &iam.User{UserName: in.UserName}}, nil
+}
+
+func (c *fakeIAMClient) CreateUserWithContext(_ aws.Context, in *iam.CreateUserInput, _ ...request.Option) (*iam.CreateUserOutput, error) {
+	c.users[*in.UserName] = &fakeIAMUser{}
+	return &iam.CreateUserOutput{User: &iam.User{UserName: in.UserName}}, nil
+}
+
+func (c *fakeIAMClient) DeleteUserWithContext(_ aws.Context, in *iam.DeleteUserInput, _ ...request.Option) (*iam.DeleteUserOutput, error) {
+	if _, ok := c.users[*in.UserName]; !ok {
+		return nil, errNoSuchEntity()
+	}
+	delete(c.users, *in.UserName)
+	return &iam.DeleteUserOutput{}, nil
+}
+
+func (c *fakeIAMClient) GetUserPolicyWithContext(_ aws.Context, in *iam.GetUserPolicyInput, _ ...request.Option) (*iam.GetUserPolicyOutput, error) {
+	user, ok := c.users[*in.UserName]
+	if !ok || user.policy == "" {
+		return nil, errNoSuchEntity()
+	}
+	return &iam.GetUserPolicyOutput{PolicyDocument: aws.String(user.policy)}, nil
+}
+
+func (c *fakeIAMClient) PutUserPolicyWithContext(_ aws.Context, in *iam.PutUserPolicyInput, _ ...request.Option) (*iam.PutUserPolicyOutput, error) {
+	user, ok := c.users[*in.UserName]
+	if !ok {
+		return nil, errNoSuchEntity()
+	}
+	user.policy = *in.PolicyDocument
+	return &iam.PutUserPolicyOutput{}, nil
+}
+
+func (c *fakeIAMClient) DeleteUserPolicyWithContext(_ aws.Context, in *iam.DeleteUserPolicyInput, _ ...request.Option) (*iam.DeleteUserPolicyOutput, error) {
+	user, ok := c.users[*in.UserName]
+	if !ok {
+		return nil, errNoSuchEntity()
+	}
+	user.policy = ""
+	return &iam.DeleteUserPolicyOutput{}, nil
+}
+
+func (c *fakeIAMClient) CreateAccessKeyWithContext(_ aws.Context, in *iam.CreateAccessKeyInput, _ ...request.Option) (*iam.CreateAccessKeyOutput, error) {
+	user, ok := c.users[*in.UserName]
+	if !ok {
+		return nil, errNoSuchEntity()
+	}
+	c.keyID++
+	keyID := fmt.Sprintf("KEY%d", c.keyID)
+	user.keys = append(user.keys, keyID)
+	return &iam.CreateAccessKeyOutput{AccessKey: &iam.AccessKey{
+		UserName:        in.UserName,
+		AccessKeyId:     aws.String(keyID),
+		SecretAccessKey: aws.String("SECRET" + keyID),
+	}}, nil
+}
+
+func (c *fakeIAMClient) ListAccessKeysWithContext(_ aws.Context, in *iam.ListAccessKeysInput, _ ...request.Option) (*iam.ListAccessKeysOutput, error) {
+	out := &iam.ListAccessKeysOutput{}
+	if user, ok := c.users[*in.UserName]; ok {
+		for _, key := range user.keys {
+			out.AccessKeyMetadata = append(out.AccessKeyMetadata, &iam.AccessKeyMetadata{AccessKeyId: aws.String(key)})
+		}
+	}
+	return out, nil
+}
+
+func (c *fakeIAMClient) DeleteAccessKeyWithContext(_ aws.Context, in *iam.DeleteAccessKeyInput, _ ...request.Option) (*iam.DeleteAccessKeyOutput, error) {
+	if user, ok := c.users[*in.UserName]; ok {
+		for i, key := range user.keys {
+			if key == *in.AccessKeyId {
+				user.keys = append(user.keys[:i], user.keys[i+1:]...)
+				break
+			}
+		}
+	}
+	return &iam.DeleteAccessKeyOutput{}, nil
+}
+
+func Test_iamIdentityBackend(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeIAMClient()
+	b := newIAMIdentityBackend(client, newStateStore(newFakeFiler().client(), "provisioner"), false)
+
+	cred, err := b.grantAccess(ctx, "user", []string{"Read:bucket-a", "Write:bucket-a"})
+	if err != nil {
+		t.Fatalf("grantAccess() error = %v", err)
+	}
+	if cred.AccessKey != "KEY1" || cred.SecretKey != "SECRETKEY1" {
+		t.Errorf("grantAccess() returned unexpected credential %v", cred)
+	}
+
+	// A second grant keeps the actions of the first one.
+	if _, err := b.grantAccess(ctx, "user", []string{"Read:bucket-b", "Read:bucket-a"}); err != nil {
+		t.Fatalf("grantAccess() error = %v", err)
+	}
+	actions, err := b.userActions(ctx, "user")
+	if err != nil {
+		t.Fatalf("userActions() error = %v", err)
+	}
+	sort.Strings(actions)
+	if want := []string{"Read:bucket-a", "Read:bucket-b", "Write:bucket-a"}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("userActions() = %v, want %v", actions, want)
+	}
+	if keys := client.users["user"].keys; len(keys) != 2 {
+		t.Errorf("expected two access keys, got %v", keys)
+	}
+
+	if err := b.revokeAccess(ctx, "user"); err != nil {
+		t.Fatalf("revokeAccess() error = %v", err)
+	}
+	if _, ok := client.users["user"]; ok {
+		t.Errorf("expected user to be deleted")
+	}
+
+	// Revoking an unknown user is not an error.
+	if err := b.revokeAccess(ctx, "user"); err != nil {
+		t.Errorf("revokeAccess() of unknown user error = %v", err)
+	}
+}
+
+func Test_iamIdentityBackend_foreignUsers(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeIAMClient()
+	client.users["foreign"] = &fakeIAMUser{keys: []string{"FOREIGNKEY"}}
+	state := newStateStore(newFakeFiler().client(), "provisioner")
+	b := newIAMIdentityBackend(client, state, false)
+
+	if _, err := b.grantAccess(ctx, "foreign", []string{"Read:bucket"}); !errors.Is(err, ErrIdentityNotManaged) {
+		t.Errorf("grantAccess() error = %v, want %v", err, ErrIdentityNotManaged)
+	}
+	if err := b.revokeAccess(ctx, "foreign"); !errors.Is(err, ErrIdentityNotManaged) {
+		t.Errorf("revokeAccess() error = %v, want %v", err, ErrIdentityNotManaged)
+	}
+	if err := b.deleteCredential(ctx, "foreign", "FOREIGNKEY"); !errors.Is(err, ErrIdentityNotManaged) {
+		t.Errorf("deleteCredential() error = %v, want %v", err, ErrIdentityNotManaged)
+	}
+	if user := client.users["foreign"]; user == nil || len(user.keys) != 1 || user.policy != "" {
+		t.Errorf("expected foreign user to be left alone, got %+v", user)
+	}
+
+	// Once adoption is allowed the user is taken over and recorded.
+	b = newIAMIdentityBackend(client, state, true)
+	if _, err := b.grantAccess(ctx, "foreign", []string{"Read:bucket"}); err != nil {
+		t.Fatalf("grantAccess() error = %v", err)
+	}
+	b = newIAMIdentityBackend(client, state, false)
+	if err := b.revokeAccess(ctx, "foreign"); err != nil {
+		t.Fatalf("revokeAccess() of adopted user error = %v", err)
+	}
+	if _, ok := client.users["foreign"]; ok {
+		t.Errorf("expected adopted user to be deleted")
+	}
+	if managed, _ := b.isManagedUser(ctx, "foreign"); managed {
+		t.Errorf("expected deleted user to be forgotten")
+	}
+}
+
+func Test_policyDocumentFromActions(t *testing.T) {
+	doc, err := policyDocumentFromActions([]string{"Read:bucket", "List:bucket", "Admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := iamPolicyDocument{
+		Version: iamPolicyVersion,
+		Statement: []iamPolicyStatement{
+			{Effect: "Allow", Action: []string{"s3:Get*", "s3:List*"}, Resource: []string{"arn:aws:s3:::bucket/*"}},
+			{Effect: "Allow", Action: []string{"s3:*"}, Resource: []string{"*"}},
+		},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("policyDocumentFromActions() = %v, want %v", doc, want)
+	}
+
+	if _, err := policyDocumentFromActions([]string{"Fly:bucket"}); err == nil {
+		t.Errorf("expected unsupported action to fail")
+	}
+	if _, err := policyDocumentFromActions([]string{"Read:bucket/team-a/*"}); err == nil {
+		t.Errorf("expected prefix-scoped action to fail")
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"github.com/seaweedfs/seaweedfs/weed/s3api/s3_constants"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// IdentityBackendFiler manages identities by editing the S3 IAM configuration file on the filer.
+	IdentityBackendFiler = "filer"
+	// IdentityBackendIAM manages identities through the IAM-compatible API of SeaweedFS.
+	IdentityBackendIAM = "iam"
+)
+
+// managedByPrefix precedes the provisioner name in the account display name of identities created by the driver.
+const managedByPrefix = "managed-by:"
+
+// identityBackend manages the S3 identities handed out to bucket consumers.
+type identityBackend interface {
+	// grantAccess adds the actions and a new credential to the user, creating the user if needed.
+	grantAccess(ctx context.Context, user string, actions []string) (*iam_pb.Credential, error)
+	// grantActions adds the actions to the user without issuing a credential, creating the user if needed.
+	grantActions(ctx context.Context, user string, actions []string) error
+	// revokeAccess removes the user together with all its credentials.
+	revokeAccess(ctx context.Context, user string) error
+	// deleteCredential removes a single credential from the user.
+	deleteCredential(ctx context.Context, user, accessKey string) error
+	// checkAccess verifies that the identities can be read.
+	checkAccess(ctx context.Context) error
+}
+
+// filerIdentityBackend manages identities by editing the S3 IAM configuration file on the filer.
+type filerIdentityBackend struct {
+	s *provisionerServer
+}
+
+// Interface guards.
+var _ identityBackend = &filerIdentityBackend{}
+
+func (b *filerIdentityBackend) grantAccess(ctx context.Context, user string, actions []string) (*iam_pb.Credential, error) {
+	accessKey, err := GenerateAccessKeyID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate access key ID: %w", err)
+	}
+	secretKey, err := GenerateSecretAccessKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret access key: %w", err)
+	}
+
+	if err := b.s.configureS3Access(ctx, user, accessKey, secretKey, actions, false); err != nil {
+		return nil, err
+	}
+
+	return &iam_pb.Credential{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}, nil
+}
+
+func (b *filerIdentityBackend) grantActions(ctx context.Context, user string, actions []string) error {
+	return b.s.configureS3Access(ctx, user, "", "", actions, false)
+}
+
+func (b *filerIdentityBackend) checkAccess(ctx context.Context) error {
+	_, err := b.s.fetchS3Configuration(ctx)
+	return err
+}
+
+func (b *filerIdentityBackend) revokeAccess(ctx context.Context, user string) error {
+	return b.s.revokeBucketAccess(ctx, user)
+}
+
+func (b *filerIdentityBackend) deleteCredential(ctx context.Context, user, accessKey string) error {
+	return b.s.updateS3Configuration(ctx, func(s3cfg *iam_pb.S3ApiConfiguration) error {
+		for _, identity := range s3cfg.Identities {
+			if identity.Name != user {
+				continue
+			}
+			if err := b.s.claimIdentity(identity); err != nil {
+				return err
+			}
+			for i, cred := range identity.Credentials {
+				if cred.AccessKey == accessKey {
+					identity.Credentials = append(identity.Credentials[:i], identity.Credentials[i+1:]...)
+					break
+				}
+			}
+			return nil
+		}
+		// User not found, nothing to do
+		return nil
+	})
+}
+
+// Get the account marking identities as created by this driver. SeaweedFS
+// authorizes identities of the admin account like identities without an
+// account, so the marker does not change what the identity may do.
+func (s *provisionerServer) managedIdentityAccount() *iam_pb.Account {
+	return &iam_pb.Account{
+		Id:          s3_constants.AccountAdminId,
+		DisplayName: managedByPrefix + s.provisioner,
+	}
+}
+
+// Check whether the identity was created by this driver.
+func (s *provisionerServer) isManagedIdentity(identity *iam_pb.Identity) bool {
+	account := identity.GetAccount()
+	return account.GetId() == s3_constants.AccountAdminId && account.GetDisplayName() == managedByPrefix+s.provisioner
+}
+
+// Make sure the driver may modify the identity, adopting it if that is allowed.
+// Identities bound to an account are never adopted, marking them would change their account.
+func (s *provisionerServer) claimIdentity(identity *iam_pb.Identity) error {
+	if s.isManagedIdentity(identity) {
+		return nil
+	}
+	if !s.adoptIdentities || identity.GetAccount() != nil {
+		return fmt.Errorf("%w: %s", ErrIdentityNotManaged, identity.Name)
+	}
+
+	klog.InfoS("adopting existing identity", "user", identity.Name)
+	identity.Account = s.managedIdentityAccount()
+	return nil
+}
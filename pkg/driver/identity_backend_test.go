@@ -0,0 +1,155 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func seedIdentities(t *testing.T, s *provisionerServer, identities ...*iam_pb.Identity) {
+	t.Helper()
+	if err := s.storeS3Configuration(context.Background(), &iam_pb.S3ApiConfiguration{Identities: identities}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createBuckets creates the buckets in the filer of the provisioner.
+func createBuckets(t *testing.T, s *provisionerServer, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := s.createBucket(context.Background(), name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func findIdentity(t *testing.T, s *provisionerServer, name string) *iam_pb.Identity {
+	t.Helper()
+	s3cfg, err := s.loadS3Configuration(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range s3cfg.Identities {
+		if identity.Name == name {
+			return identity
+		}
+	}
+	return nil
+}
+
+func Test_provisionerServer_identityOwnership(t *testing.T) {
+	ctx := context.Background()
+	adminCred := &iam_pb.Credential{AccessKey: "ADMIN", SecretKey: "ADMINSECRET"}
+
+	for _, tc := range []struct {
+		name        string
+		existing    *iam_pb.Identity
+		adopt       bool
+		wantCode    codes.Code
+		wantManaged bool
+	}{
+		{
+			name:     "refuses unmanaged identity",
+			existing: &iam_pb.Identity{Name: "admin", Credentials: []*iam_pb.Credential{adminCred}},
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:        "adopts unmanaged identity",
+			existing:    &iam_pb.Identity{Name: "admin", Credentials: []*iam_pb.Credential{adminCred}},
+			adopt:       true,
+			wantCode:    codes.OK,
+			wantManaged: true,
+		},
+		{
+			name:     "never adopts identity bound to an account",
+			existing: &iam_pb.Identity{Name: "admin", Account: &iam_pb.Account{Id: "ops"}},
+			adopt:    true,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "refuses identity of another driver",
+			existing: &iam_pb.Identity{Name: "admin", Account: &iam_pb.Account{Id: "admin", DisplayName: managedByPrefix + "other"}},
+			adopt:    true,
+			wantCode: codes.FailedPrecondition,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &provisionerServer{
+				provisioner:     "provisioner",
+				filerClient:     newFakeFiler().client(),
+				adoptIdentities: tc.adopt,
+			}
+			seedIdentities(t, s, tc.existing)
+			createBuckets(t, s, "bucket")
+
+			_, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "admin"})
+			if code := status.Code(err); code != tc.wantCode {
+				t.Errorf("DriverGrantBucketAccess() code = %v, want %v", code, tc.wantCode)
+			}
+			_, err = s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{AccountId: "admin"})
+			if code := status.Code(err); code != tc.wantCode {
+				t.Errorf("DriverRevokeBucketAccess() code = %v, want %v", code, tc.wantCode)
+			}
+
+			identity := findIdentity(t, s, "admin")
+			if tc.wantManaged {
+				if identity != nil {
+					t.Errorf("expected adopted identity to be revoked")
+				}
+				return
+			}
+			if identity == nil || len(identity.Actions) != 0 {
+				t.Errorf("expected unmanaged identity to be left alone, got %v", identity)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_identityPrefix(t *testing.T) {
+	ctx := context.Background()
+	s := &provisionerServer{
+		provisioner:    "provisioner",
+		filerClient:    newFakeFiler().client(),
+		identityPrefix: "cosi-",
+	}
+	createBuckets(t, s, "bucket")
+
+	resp, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.AccountId != "cosi-ba-1" {
+		t.Errorf("expected prefixed account, got %s", resp.AccountId)
+	}
+	if identity := findIdentity(t, s, "cosi-ba-1"); identity == nil || !s.isManagedIdentity(identity) {
+		t.Errorf("expected managed identity, got %v", identity)
+	}
+
+	_, err = s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{AccountId: "ba-1"})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected account without prefix to be refused, got %v", err)
+	}
+	if _, err := s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{AccountId: resp.AccountId}); err != nil {
+		t.Errorf("DriverRevokeBucketAccess() error = %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+const (
+	// leaderLockPrefix precedes the provisioner name in the name of the filer lock replicas compete for.
+	leaderLockPrefix = "seaweedfs-cosi-driver/"
+	// defaultLeaderLease is how long leadership lasts without renewal if no lease is configured.
+	defaultLeaderLease = 15 * time.Second
+	// leaderStepDownTimeout limits how long releasing the leadership may take on shutdown.
+	leaderStepDownTimeout = 5 * time.Second
+)
+
+// leaderElector competes for a distributed lock on the filer with the other
+// replicas of the driver. The replica holding the lock is the leader until it
+// fails to renew the lock within the lease or steps down.
+type leaderElector struct {
+	client   filer_pb.SeaweedFilerClient
+	name     string
+	identity string
+	lease    time.Duration
+	now      func() time.Time
+
+	// renewMu serializes the lock and unlock calls.
+	renewMu sync.Mutex
+
+	mu        sync.Mutex
+	token     string
+	renewedAt time.Time
+	leader    string
+	leading   bool
+	stopped   bool
+	inflight  sync.WaitGroup
+}
+
+func newLeaderElector(client filer_pb.SeaweedFilerClient, provisioner, identity string, lease time.Duration) *leaderElector {
+	return &leaderElector{
+		client:   client,
+		name:     leaderLockPrefix + provisioner,
+		identity: identity,
+		lease:    lease,
+		now:      time.Now,
+	}
+}
+
+// isLeaderLocked reports whether the lock is held and the lease has not run out.
+func (e *leaderElector) isLeaderLocked() bool {
+	return !e.stopped && e.token != "" && e.now().Before(e.renewedAt.Add(e.lease))
+}
+
+// notLeaderError returns the Unavailable error followers fail mutations with.
+func (e *leaderElector) notLeaderError() error {
+	if e.leader == "" || e.leader == e.identity {
+		return status.Error(codes.Unavailable, "not the leader, no leader elected")
+	}
+	return status.Error(codes.Unavailable, fmt.Sprintf("not the leader, %s is", e.leader))
+}
+
+// acquire returns a function to call once the mutation it guards finished, or
+// an Unavailable error if this replica is not the leader. Without leader
+// election, a nil elector, every replica may mutate.
+func (e *leaderElector) acquire() (func(), error) {
+	if e == nil {
+		return func() {}, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.isLeaderLocked() {
+		return nil, e.notLeaderError()
+	}
+	e.inflight.Add(1)
+	return e.inflight.Done, nil
+}
+
+// check fails on followers, so they are reported as not ready.
+func (e *leaderElector) check(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.isLeaderLocked() {
+		return e.notLeaderError()
+	}
+	return nil
+}
+
+// campaign acquires the lock, or renews it if this replica holds it already.
+func (e *leaderElector) campaign(ctx context.Context) error {
+	e.renewMu.Lock()
+	defer e.renewMu.Unlock()
+
+	e.mu.Lock()
+	token, stopped := e.token, e.stopped
+	e.mu.Unlock()
+	if stopped {
+		return nil
+	}
+
+	start := e.now()
+	resp, err := e.client.DistributedLock(ctx, &filer_pb.LockRequest{
+		Name:          e.name,
+		SecondsToLock: max(int64(e.lease/time.Second), 1),
+		RenewToken:    token,
+		Owner:         e.identity,
+	})
+	// The filer refusing the lock means it is held by another replica or,
+	// when renewing, that it was lost. Other errors leave the lease to decide.
+	refused := err == nil && resp.GetError() != ""
+	if refused {
+		err = errors.New(resp.GetError())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case err == nil:
+		e.token = resp.GetRenewToken()
+		e.renewedAt = start
+		e.leader = e.identity
+	case refused:
+		e.token = ""
+		if owner := resp.GetLockOwner(); owner != "" {
+			e.leader = owner
+		}
+	}
+	if leading := e.isLeaderLocked(); leading != e.leading {
+		e.leading = leading
+		if leading {
+			klog.InfoS("became the leader", "lock", e.name, "identity", e.identity)
+			leaderGauge.Set(1)
+		} else {
+			klog.InfoS("lost the leadership", "lock", e.name, "leader", e.leader)
+			leaderGauge.Set(0)
+		}
+	}
+	return err
+}
+
+// run campaigns for the lock three times per lease until the context is cancelled.
+func (e *leaderElector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		if err := e.campaign(ctx); err != nil {
+			klog.V(4).InfoS("not the leader", "lock", e.name, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stepDown stops accepting mutations, waits for the ongoing ones and releases
+// the lock, so another replica takes over without waiting for the lease to run out.
+func (e *leaderElector) stepDown(ctx context.Context) error {
+	e.mu.Lock()
+	e.stopped = true
+	e.mu.Unlock()
+	e.inflight.Wait()
+
+	e.renewMu.Lock()
+	defer e.renewMu.Unlock()
+
+	e.mu.Lock()
+	token := e.token
+	e.token = ""
+	e.mu.Unlock()
+	leaderGauge.Set(0)
+	if token == "" {
+		return nil
+	}
+
+	klog.InfoS("stepping down as the leader", "lock", e.name)
+	resp, err := e.client.DistributedUnlock(ctx, &filer_pb.UnlockRequest{
+		Name:       e.name,
+		RenewToken: token,
+	})
+	if err == nil && resp.GetError() != "" {
+		err = errors.New(resp.GetError())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release leadership: %w", err)
+	}
+	return nil
+}
+
+// leaderServer serves the COSI RPCs and administrative changes only while the
+// replica is the leader. Followers fail them with Unavailable, so the sidecar
+// retries until the leader's sidecar handled them, and are reported not ready.
+type leaderServer struct {
+	driverServer
+	leader *leaderElector
+}
+
+// Interface guards.
+var _ cosispec.ProvisionerServer = &leaderServer{}
+
+func (s *leaderServer) DriverCreateBucket(ctx context.Context, req *cosispec.DriverCreateBucketRequest) (*cosispec.DriverCreateBucketResponse, error) {
+	release, err := s.leader.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.driverServer.DriverCreateBucket(ctx, req)
+}
+
+func (s *leaderServer) DriverDeleteBucket(ctx context.Context, req *cosispec.DriverDeleteBucketRequest) (*cosispec.DriverDeleteBucketResponse, error) {
+	release, err := s.leader.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.driverServer.DriverDeleteBucket(ctx, req)
+}
+
+func (s *leaderServer) DriverGrantBucketAccess(ctx context.Context, req *cosispec.DriverGrantBucketAccessRequest) (*cosispec.DriverGrantBucketAccessResponse, error) {
+	release, err := s.leader.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.driverServer.DriverGrantBucketAccess(ctx, req)
+}
+
+func (s *leaderServer) DriverRevokeBucketAccess(ctx context.Context, req *cosispec.DriverRevokeBucketAccessRequest) (*cosispec.DriverRevokeBucketAccessResponse, error) {
+	release, err := s.leader.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.driverServer.DriverRevokeBucketAccess(ctx, req)
+}
+
+// adminHandler only lets the leader serve requests changing credentials.
+func (s *leaderServer) adminHandler() http.Handler {
+	handler := s.driverServer.adminHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			release, err := s.leader.acquire()
+			if err != nil {
+				http.Error(w, status.Convert(err).Message(), http.StatusServiceUnavailable)
+				return
+			}
+			defer release()
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (s *leaderServer) readinessChecks() []readinessCheck {
+	return append(s.driverServer.readinessChecks(), readinessCheck{"leader", s.leader.check})
+}
+
+func (s *leaderServer) stepDown(ctx context.Context) error {
+	return s.leader.stepDown(ctx)
+}
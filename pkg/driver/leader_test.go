@@ -0,0 +1,245 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+// fakeLockManager implements the distributed locks of the filer for a single lock.
+type fakeLockManager struct {
+	mu      sync.Mutex
+	now     time.Time
+	owner   string
+	token   string
+	expires time.Time
+	tokens  int
+}
+
+func (m *fakeLockManager) advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = m.now.Add(d)
+}
+
+func (m *fakeLockManager) clock() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+func (m *fakeLockManager) client() *mockSeaweedFilerClient {
+	return &mockSeaweedFilerClient{
+		distributedLockFunc: func(ctx context.Context, in *filer_pb.LockRequest, opts ...grpc.CallOption) (*filer_pb.LockResponse, error) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			held := m.token != "" && m.now.Before(m.expires)
+			switch {
+			case held && in.RenewToken != m.token:
+				return &filer_pb.LockResponse{LockOwner: m.owner, Error: fmt.Sprintf("lock already owned by %v", m.owner)}, nil
+			case !held && in.RenewToken != "":
+				return &filer_pb.LockResponse{Error: "lock: non-empty token on an expired lock"}, nil
+			}
+			m.tokens++
+			m.owner, m.token = in.Owner, fmt.Sprintf("token-%d", m.tokens)
+			m.expires = m.now.Add(time.Duration(in.SecondsToLock) * time.Second)
+			return &filer_pb.LockResponse{LockOwner: m.owner, RenewToken: m.token}, nil
+		},
+		distributedUnlockFunc: func(ctx context.Context, in *filer_pb.UnlockRequest, opts ...grpc.CallOption) (*filer_pb.UnlockResponse, error) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if in.RenewToken != m.token {
+				return &filer_pb.UnlockResponse{Error: "unlock: token mismatch"}, nil
+			}
+			m.owner, m.token = "", ""
+			return &filer_pb.UnlockResponse{}, nil
+		},
+	}
+}
+
+func newTestLeaderElector(m *fakeLockManager, identity string) *leaderElector {
+	e := newLeaderElector(m.client(), "provisioner", identity, 15*time.Second)
+	e.now = m.clock
+	return e
+}
+
+func Test_leaderElector(t *testing.T) {
+	ctx := context.Background()
+	locks := &fakeLockManager{now: time.Now()}
+	a := newTestLeaderElector(locks, "replica-a")
+	b := newTestLeaderElector(locks, "replica-b")
+
+	// The first replica becomes the leader, the other one follows
+	if err := a.campaign(ctx); err != nil {
+		t.Fatalf("campaign() error = %v", err)
+	}
+	if err := b.campaign(ctx); err == nil {
+		t.Fatalf("expected second replica not to acquire the lock")
+	}
+	if _, err := a.acquire(); err != nil {
+		t.Errorf("expected leader to accept mutations, got %v", err)
+	}
+	if _, err := b.acquire(); status.Code(err) != codes.Unavailable || status.Convert(err).Message() != "not the leader, replica-a is" {
+		t.Errorf("expected follower to refuse mutations, got %v", err)
+	}
+
+	// Renewals keep the leadership beyond the lease
+	for i := 0; i < 3; i++ {
+		locks.advance(10 * time.Second)
+		if err := a.campaign(ctx); err != nil {
+			t.Fatalf("campaign() error = %v", err)
+		}
+	}
+	if err := a.check(ctx); err != nil {
+		t.Errorf("expected leader to be ready, got %v", err)
+	}
+
+	// A leader failing to renew loses the leadership with the lease
+	locks.advance(20 * time.Second)
+	if err := a.check(ctx); err == nil {
+		t.Errorf("expected leadership to end with the lease")
+	}
+	if err := b.campaign(ctx); err != nil {
+		t.Fatalf("campaign() error = %v", err)
+	}
+	if err := a.campaign(ctx); err == nil {
+		t.Errorf("expected former leader not to renew the lock")
+	}
+	if _, err := a.acquire(); status.Convert(err).Message() != "not the leader, replica-b is" {
+		t.Errorf("expected former leader to follow, got %v", err)
+	}
+
+	// Stepping down waits for ongoing mutations and hands the lock over
+	release, err := b.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stepped := make(chan error)
+	go func() {
+		stepped <- b.stepDown(ctx)
+	}()
+	select {
+	case err := <-stepped:
+		t.Fatalf("expected step down to wait for the ongoing mutation, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	if err := <-stepped; err != nil {
+		t.Fatalf("stepDown() error = %v", err)
+	}
+	if _, err := b.acquire(); err == nil {
+		t.Errorf("expected replica to refuse mutations after stepping down")
+	}
+	if err := a.campaign(ctx); err != nil {
+		t.Errorf("expected other replica to take over right away, got %v", err)
+	}
+}
+
+func Test_leaderServer(t *testing.T) {
+	ctx := context.Background()
+	locks := &fakeLockManager{now: time.Now()}
+	other := newTestLeaderElector(locks, "replica-a")
+	leader := newTestLeaderElector(locks, "replica-b")
+	s := &leaderServer{driverServer: newClusterProvisionerServer(""), leader: leader}
+
+	// Followers refuse RPCs and changes through the admin API, and are not ready
+	if err := other.campaign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.campaign(ctx); err == nil {
+		t.Fatalf("expected lock to be held by the other replica")
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable on follower, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/accounts/ba/rotate", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected rotation on follower to fail with 503, got %d", rec.Code)
+	}
+	r := newReadiness(s.readinessChecks())
+	r.check(ctx)
+	if ready, failures := r.ready(); ready || !contains(failures, "leader: rpc error: code = Unavailable desc = not the leader, replica-a is") {
+		t.Errorf("expected follower not to be ready, got %v", failures)
+	}
+
+	// The leader serves them
+	if err := other.stepDown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.campaign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DriverCreateBucket(ctx, &cosispec.DriverCreateBucketRequest{Name: "bucket"}); err != nil {
+		t.Errorf("DriverCreateBucket() error = %v", err)
+	}
+	if err := s.stepDown(ctx); err != nil {
+		t.Errorf("stepDown() error = %v", err)
+	}
+}
+
+func Test_stateStore_leadershipChange(t *testing.T) {
+	ctx := context.Background()
+	filerClient := newFakeFiler().client()
+	previous := newStateStore(filerClient, "provisioner")
+	next := newStateStore(filerClient, "provisioner")
+
+	// The standby reads the state on startup, before the leader records anything.
+	if err := next.view(ctx, func(*driverState) {}); err != nil {
+		t.Fatal(err)
+	}
+	err := previous.update(ctx, func(state *driverState) error {
+		state.Accounts["ba-1"] = &accountState{Credentials: []*credentialRecord{{AccessKey: "KEY1"}}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once it leads, its changes must not drop those of the previous leader.
+	err = next.update(ctx, func(state *driverState) error {
+		state.Accounts["ba-2"] = &accountState{Credentials: []*credentialRecord{{AccessKey: "KEY2"}}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accounts []string
+	err = previous.view(ctx, func(state *driverState) {
+		for account := range state.Accounts {
+			accounts = append(accounts, account)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 {
+		t.Errorf("expected the accounts of both leaders, got %v", accounts)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// metricsNamespace precedes the names of all metrics of the driver.
+const metricsNamespace = "seaweedfs_cosi"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_requests_total",
+		Help:      "COSI RPCs handled by the driver, by method and result code.",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of the COSI RPCs handled by the driver, by method and result code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	filerRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "filer_requests_total",
+		Help:      "RPCs sent to the filers, by filer, method and result code.",
+	}, []string{"filer", "method", "code"})
+	filerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "filer_request_duration_seconds",
+		Help:      "Latency of the RPCs sent to the filers, by filer and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"filer", "method"})
+	filerRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "filer_retries_total",
+		Help:      "Filer calls retried after transient failures, by method.",
+	}, []string{"method"})
+	filerCircuitRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "filer_circuit_rejections_total",
+		Help:      "Filer calls failed fast while the circuit breaker was open.",
+	})
+
+	iamConfigBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "iam_config_bytes",
+		Help:      "Size of the S3 IAM configuration last read or written, by cluster.",
+	}, []string{"cluster"})
+	iamIdentities = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "iam_identities",
+		Help:      "Number of identities in the S3 IAM configuration last read or written, by cluster.",
+	}, []string{"cluster"})
+
+	agedAccounts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "aged_accounts",
+		Help:      "Number of accounts whose newest key is older than the maximum key age, by cluster.",
+	}, []string{"cluster"})
+
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Whether the replica is the elected leader, 1 if it is.",
+	})
+
+	lockWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent waiting for locks of the driver, by lock.",
+		Buckets:   []float64{.0001, .001, .01, .1, .5, 1, 5, 10, 30},
+	}, []string{"lock"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rpcRequests, rpcDuration,
+		filerRequests, filerDuration,
+		filerRetries, filerCircuitRejections,
+		iamConfigBytes, iamIdentities,
+		agedAccounts,
+		leaderGauge,
+		lockWait,
+	)
+}
+
+// metricsHandler serves the metrics of the driver in the Prometheus format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// unaryServerMetrics records the result and latency of every RPC served by the driver.
+func unaryServerMetrics(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	method, code := path.Base(info.FullMethod), status.Code(err).String()
+	rpcRequests.WithLabelValues(method, code).Inc()
+	rpcDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// unaryFilerMetrics records the result and latency of every RPC sent to a filer.
+func unaryFilerMetrics(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	observeFilerRequest(cc.Target(), method, start, err)
+	return err
+}
+
+// streamFilerMetrics records the result and latency of opening streams to a filer.
+func streamFilerMetrics(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	observeFilerRequest(cc.Target(), method, start, err)
+	return stream, err
+}
+
+func observeFilerRequest(filer, method string, start time.Time, err error) {
+	method = path.Base(method)
+	filerRequests.WithLabelValues(filer, method, status.Code(err).String()).Inc()
+	filerDuration.WithLabelValues(filer, method).Observe(time.Since(start).Seconds())
+}
+
+// lockObserved locks mu and records how long that took.
+func lockObserved(mu sync.Locker, name string) {
+	start := time.Now()
+	mu.Lock()
+	lockWait.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
+
+// observeIAMConfig records the size of the S3 IAM configuration of the cluster,
+// which is empty for the default cluster.
+func observeIAMConfig(cluster string, size, identities int) {
+	iamConfigBytes.WithLabelValues(cluster).Set(float64(size))
+	iamIdentities.WithLabelValues(cluster).Set(float64(identities))
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func Test_unaryServerMetrics(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/cosi.v1alpha1.Provisioner/DriverCreateBucket"}
+	failed := rpcRequests.WithLabelValues("DriverCreateBucket", "InvalidArgument")
+	succeeded := rpcRequests.WithLabelValues("DriverCreateBucket", "OK")
+	failedBefore, succeededBefore := testutil.ToFloat64(failed), testutil.ToFloat64(succeeded)
+
+	handlerErr := status.Error(codes.InvalidArgument, "invalid")
+	handler := func(ctx context.Context, req any) (any, error) {
+		return nil, handlerErr
+	}
+	if _, err := unaryServerMetrics(context.Background(), nil, info, handler); err != handlerErr {
+		t.Errorf("expected handler error to be returned, got %v", err)
+	}
+	handlerErr = nil
+	if _, err := unaryServerMetrics(context.Background(), nil, info, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(failed) - failedBefore; got != 1 {
+		t.Errorf("expected one failed request, got %v", got)
+	}
+	if got := testutil.ToFloat64(succeeded) - succeededBefore; got != 1 {
+		t.Errorf("expected one successful request, got %v", got)
+	}
+}
+
+func Test_metricsHandler(t *testing.T) {
+	s := newStatefulProvisionerServer()
+	if _, err := s.DriverGrantBucketAccess(context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Each cluster reports its own configuration
+	eu := newStatefulProvisionerServer()
+	eu.cluster = "eu"
+	for _, name := range []string{"ba-1", "ba-2"} {
+		if _, err := eu.DriverGrantBucketAccess(context.Background(), &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if identities := testutil.ToFloat64(iamIdentities.WithLabelValues("")); identities != 1 {
+		t.Errorf("expected one identity in the default cluster, got %v", identities)
+	}
+	if identities := testutil.ToFloat64(iamIdentities.WithLabelValues("eu")); identities != 2 {
+		t.Errorf("expected two identities in cluster eu, got %v", identities)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, name := range []string{"seaweedfs_cosi_iam_config_bytes", "seaweedfs_cosi_iam_identities", `seaweedfs_cosi_lock_wait_seconds_count{lock="state"}`} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("expected metrics to contain %s", name)
+		}
+	}
+}
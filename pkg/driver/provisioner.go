@@ -23,33 +23,68 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/seaweedfs/seaweedfs-cosi-driver/pkg/util/s3client"
 	"github.com/seaweedfs/seaweedfs/weed/filer"
 	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
 	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"github.com/seaweedfs/seaweedfs/weed/pb/master_pb"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"k8s.io/klog/v2"
 	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
 )
 
 // provisionerServer implements cosi.ProvisionerServer interface.
 type provisionerServer struct {
-	provisioner      string
-	filerClient      filer_pb.SeaweedFilerClient
-	filerBucketsPath string
-	endpoint         string
-	region           string
+	provisioner        string
+	cluster            string
+	filerClient        filer_pb.SeaweedFilerClient
+	filerBucketsPath   string
+	endpoint           string
+	region             string
+	s3ConfigBatcher    *s3ConfigBatcher
+	s3ConfigCache      *s3ConfigCache
+	identities         identityBackend
+	identityPrefix     string
+	adoptIdentities    bool
+	state              *stateStore
+	recordCredentials  bool
+	rotationOverlap    time.Duration
+	maxKeyAge          time.Duration
+	credentialCheck    time.Duration
+	s3Agent            *s3client.S3Agent
+	bucketPolicyMu     sync.Mutex
+	anonymousAllowlist []string
+	pathStyle          bool
+	caBundleFile       string
+	signatureVersion   string
+	leader             *leaderElector
+	compatibility      filerCompatibility
 }
 
 // Interface guards.
 var _ cosispec.ProvisionerServer = &provisionerServer{}
 
+// prefixParameter is the BucketAccessClass parameter limiting access to the keys below a prefix.
+// The granted prefix is handed out under the same key.
+const prefixParameter = "prefix"
+
+// credentialTTLParameter is the BucketAccessClass parameter limiting how long issued credentials are valid.
+const credentialTTLParameter = "credentialTTL"
+
 func randomHex(n int) (string, error) {
 	bytes := make([]byte, n)
 	if _, err := rand.Read(bytes); err != nil {
@@ -58,13 +93,47 @@ func randomHex(n int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// Create a new SeaweedFS Filer client for interacting with the Filer.
-func createFilerClient(filerEndpoint string, grpcDialOption grpc.DialOption) (filer_pb.SeaweedFilerClient, error) {
-	conn, err := grpc.Dial(filerEndpoint, grpcDialOption)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to filer: %w", err)
+// Create a new SeaweedFS Filer client for interacting with the Filer. The
+// client fails over between the listed filers and those registered with the master.
+func createFilerClient(ctx context.Context, opts Options) (filer_pb.SeaweedFilerClient, error) {
+	client := newFailoverFilerClient(func(address string) (filer_pb.SeaweedFilerClient, error) {
+		conn, err := grpc.Dial(address, opts.GRPCDialOption,
+			grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+			grpc.WithChainUnaryInterceptor(unaryFilerMetrics),
+			grpc.WithChainStreamInterceptor(streamFilerMetrics))
+		if err != nil {
+			return nil, err
+		}
+		return filer_pb.NewSeaweedFilerClient(conn), nil
+	})
+	if err := client.addFilers(splitFilerAddresses(opts.FilerEndpoint)); err != nil {
+		return nil, err
+	}
+
+	if opts.MasterEndpoint != "" {
+		conn, err := grpc.Dial(opts.MasterEndpoint, opts.GRPCDialOption)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to master: %w", err)
+		}
+		client.discover = masterFilerDiscovery(master_pb.NewSeaweedClient(conn))
+		if err := client.discoverFilers(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if len(client.filers) == 0 {
+		return nil, fmt.Errorf("failed to connect to filer: no filer configured")
 	}
-	return filer_pb.NewSeaweedFilerClient(conn), nil
+
+	if opts.FilerHealthCheckInterval > 0 {
+		go client.run(ctx, opts.FilerHealthCheckInterval)
+	}
+	retry := retryPolicy{
+		attempts:   opts.FilerRetryAttempts,
+		backoff:    opts.FilerRetryBackoff,
+		maxBackoff: opts.FilerRetryMaxBackoff,
+	}
+	breaker := newCircuitBreaker(opts.FilerCircuitBreakerThreshold, opts.FilerCircuitBreakerCooldown)
+	return newResilientFilerClient(client, retry, breaker), nil
 }
 
 // Get the directory path in the Filer where buckets are stored.
@@ -74,9 +143,15 @@ func getFilerBucketsPath(filerClient filer_pb.SeaweedFilerClient) (string, error
 }
 
 // NewProvisionerServer returns provisioner.Server with initialized clients.
-func NewProvisionerServer(provisioner, filerEndpoint, endpoint, region string, grpcDialOption grpc.DialOption) (cosispec.ProvisionerServer, error) {
+func NewProvisionerServer(ctx context.Context, provisioner string, opts Options) (cosispec.ProvisionerServer, error) {
+	return newProvisionerServer(ctx, provisioner, opts, nil)
+}
+
+// newProvisionerServer returns the provisioner server of a cluster, the
+// credential maintenance of which only runs while the replica leads.
+func newProvisionerServer(ctx context.Context, provisioner string, opts Options, leader *leaderElector) (*provisionerServer, error) {
 	// Create filer client here
-	filerClient, err := createFilerClient(filerEndpoint, grpcDialOption)
+	filerClient, err := createFilerClient(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -87,22 +162,76 @@ func NewProvisionerServer(provisioner, filerEndpoint, endpoint, region string, g
 		return nil, err
 	}
 
-	return &provisionerServer{
-		provisioner:      provisioner,
-		filerClient:      filerClient,
-		filerBucketsPath: filerBucketsPath,
-		endpoint:         endpoint,
-		region:           region,
-	}, nil
+	s := &provisionerServer{
+		provisioner:        provisioner,
+		cluster:            opts.cluster,
+		filerClient:        filerClient,
+		filerBucketsPath:   filerBucketsPath,
+		endpoint:           opts.Endpoint,
+		region:             opts.Region,
+		identityPrefix:     opts.IdentityPrefix,
+		adoptIdentities:    opts.AdoptExistingIdentities,
+		state:              newStateStore(filerClient, provisioner),
+		recordCredentials:  opts.AdminAddress != "" || opts.MaxKeyAge > 0,
+		rotationOverlap:    opts.KeyRotationOverlap,
+		maxKeyAge:          opts.MaxKeyAge,
+		credentialCheck:    opts.CredentialCheckInterval,
+		anonymousAllowlist: opts.AnonymousAccessAllowlist,
+		pathStyle:          opts.PathStyle,
+		caBundleFile:       opts.CABundleFile,
+		signatureVersion:   opts.SignatureVersion,
+		leader:             leader,
+		compatibility:      filerCompatibility{strict: opts.StrictFilerVersion},
+	}
+
+	switch opts.IdentityBackend {
+	case IdentityBackendIAM:
+		iamClient, err := createIAMClient(opts.IAMEndpoint, opts.IAMAccessKeyID, opts.IAMSecretAccessKey, opts.Region)
+		if err != nil {
+			return nil, err
+		}
+		s.identities = newIAMIdentityBackend(iamClient, s.state, opts.AdoptExistingIdentities)
+	case IdentityBackendFiler, "":
+		s.identities = &filerIdentityBackend{s: s}
+		s.s3ConfigBatcher = newS3ConfigBatcher(opts.IAMBatchWindow, s.loadS3Configuration, s.storeS3Configuration)
+		if opts.IAMConfigCache {
+			s.s3ConfigCache = newS3ConfigCache(filerClient, provisioner, s.fetchS3Configuration)
+			go s.s3ConfigCache.run(ctx)
+		}
+	default:
+		return nil, fmt.Errorf("unknown identity backend %q", opts.IdentityBackend)
+	}
+
+	if opts.BucketPolicy {
+		s.s3Agent, err = s3client.NewS3Agent(opts.S3AccessKeyID, opts.S3SecretAccessKey, opts.Endpoint, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 client: %w", err)
+		}
+	}
+
+	if opts.CredentialCheckInterval > 0 {
+		go s.runCredentialMaintenance(ctx, opts.CredentialCheckInterval)
+	}
+
+	return s, nil
+}
+
+// Get the backend managing S3 identities, editing the S3 configuration on the Filer by default.
+func (s *provisionerServer) identityBackend() identityBackend {
+	if s.identities != nil {
+		return s.identities
+	}
+	return &filerIdentityBackend{s: s}
 }
 
 // Create a bucket in SeaweedFS using the Filer.
-func (s *provisionerServer) createBucket(ctx context.Context, bucketName string) error {
+func (s *provisionerServer) createBucket(ctx context.Context, bucketName string, extended map[string][]byte) error {
 	req := &filer_pb.CreateEntryRequest{
 		Directory: s.filerBucketsPath,
 		Entry: &filer_pb.Entry{
 			Name:        bucketName,
 			IsDirectory: true,
+			Extended:    extended,
 			Attributes: &filer_pb.FuseAttributes{
 				FileMode: uint32(0777 | os.ModeDir),
 				Crtime:   time.Now().Unix(),
@@ -111,9 +240,12 @@ func (s *provisionerServer) createBucket(ctx context.Context, bucketName string)
 		},
 	}
 
-	_, err := s.filerClient.CreateEntry(ctx, req)
+	resp, err := s.filerClient.CreateEntry(ctx, req)
+	if err == nil && resp.GetError() != "" {
+		err = errors.New(resp.GetError())
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create bucket in filer: %w", err)
+		return fmt.Errorf("failed to create bucket in filer: %w", classifyError(err))
 	}
 	return nil
 }
@@ -127,9 +259,12 @@ func (s *provisionerServer) deleteBucket(ctx context.Context, bucketId string) e
 		IsRecursive:          true,
 		IgnoreRecursiveError: true,
 	}
-	_, err := s.filerClient.DeleteEntry(ctx, req)
+	resp, err := s.filerClient.DeleteEntry(ctx, req)
+	if err == nil && resp.GetError() != "" {
+		err = errors.New(resp.GetError())
+	}
 	if err != nil {
-		return fmt.Errorf("failed to delete bucket in filer: %w", err)
+		return fmt.Errorf("failed to delete bucket in filer: %w", classifyError(err))
 	}
 	return nil
 }
@@ -140,12 +275,35 @@ func (s *provisionerServer) DriverCreateBucket(
 	req *cosispec.DriverCreateBucketRequest,
 ) (*cosispec.DriverCreateBucketResponse, error) {
 	klog.InfoS("creating bucket", "name", req.GetName())
+	if err := s.compatibility.check(); err != nil {
+		return nil, err
+	}
+
+	anonymousAccess, err := s.checkAnonymousAccess(req.GetName(), req.GetParameters()[anonymousAccessParameter])
+	if err != nil {
+		klog.ErrorS(err, "refusing to create bucket", "name", req.GetName())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Record the endpoint and region of the BucketClass, so grants advertise them
+	location, err := s.defaultLocation().withParameters(req.GetParameters())
+	if err != nil {
+		klog.ErrorS(err, "refusing to create bucket", "name", req.GetName())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	// Implement bucket creation logic using SeaweedFS filer client
-	err := s.createBucket(ctx, req.GetName())
+	err = s.createBucket(ctx, req.GetName(), location.bucketMetadata())
 	if err != nil {
 		klog.ErrorS(err, "failed to create bucket", "name", req.GetName())
-		return nil, status.Error(codes.Internal, "failed to create bucket")
+		return nil, rpcError(err, "failed to create bucket")
+	}
+
+	if anonymousAccess {
+		if err := s.setAnonymousAccess(ctx, req.GetName(), true); err != nil {
+			klog.ErrorS(err, "failed to grant anonymous access", "name", req.GetName())
+			return nil, rpcError(err, "failed to grant anonymous access")
+		}
 	}
 
 	klog.InfoS("successfully created bucket", "name", req.GetName())
@@ -160,12 +318,23 @@ func (s *provisionerServer) DriverDeleteBucket(
 	req *cosispec.DriverDeleteBucketRequest,
 ) (*cosispec.DriverDeleteBucketResponse, error) {
 	klog.InfoS("deleting bucket", "id", req.GetBucketId())
+	if err := s.compatibility.check(); err != nil {
+		return nil, err
+	}
+
+	// Anonymous access must not carry over to a new bucket of the same name
+	if _, ok := s.identityBackend().(*filerIdentityBackend); ok {
+		if err := s.setAnonymousAccess(ctx, req.GetBucketId(), false); err != nil {
+			klog.ErrorS(err, "failed to remove anonymous access", "id", req.GetBucketId())
+			return nil, rpcError(err, "failed to remove anonymous access")
+		}
+	}
 
 	// Implement bucket deletion logic using SeaweedFS filer client
 	err := s.deleteBucket(ctx, req.GetBucketId())
-	if err != nil {
+	if err != nil && !isNotFound(err) {
 		klog.ErrorS(err, "failed to delete bucket", "id", req.GetBucketId())
-		return nil, status.Error(codes.Internal, "failed to delete bucket")
+		return nil, rpcError(err, "failed to delete bucket")
 	}
 
 	klog.InfoS("successfully deleted bucket", "id", req.GetBucketId())
@@ -177,7 +346,7 @@ func (s *provisionerServer) revokeBucketAccess(ctx context.Context, userId strin
 	err := s.configureS3Access(ctx, userId, "", "", nil, true)
 	if err != nil {
 		// Check if the error is because the entry was not found
-		if strings.HasSuffix(err.Error(), "no entry is found in filer store") {
+		if isNotFound(err) {
 			klog.InfoS("no entry found in filer store, treating as success", "user", userId)
 			return nil
 		}
@@ -189,69 +358,138 @@ func (s *provisionerServer) revokeBucketAccess(ctx context.Context, userId strin
 
 // Configure S3 access in SeaweedFS.
 func (s *provisionerServer) configureS3Access(ctx context.Context, user, accessKey, secretKey string, actions []string, isDelete bool) error {
-	var buf bytes.Buffer
-	if err := s.readS3Configuration(ctx, &buf); err != nil {
-		return err
-	}
-
-	s3cfg := &iam_pb.S3ApiConfiguration{}
-	if buf.Len() > 0 {
-		if err := filer.ParseS3ConfigurationFromBytes(buf.Bytes(), s3cfg); err != nil {
-			return err
+	return s.updateS3Configuration(ctx, func(s3cfg *iam_pb.S3ApiConfiguration) error {
+		idx := -1
+		for i, identity := range s3cfg.Identities {
+			if user == identity.Name {
+				idx = i
+				break
+			}
 		}
-	}
 
-	idx := -1
-	for i, identity := range s3cfg.Identities {
-		if user == identity.Name {
-			idx = i
-			break
+		if idx == -1 && isDelete {
+			// User not found and trying to delete, nothing to do
+			return nil
 		}
-	}
 
-	if idx == -1 && isDelete {
-		// User not found and trying to delete, nothing to do
-		return nil
-	}
-
-	if idx == -1 {
-		// Add new user
-		identity := iam_pb.Identity{
-			Name:        user,
-			Actions:     actions,
-			Credentials: []*iam_pb.Credential{},
-		}
-		if accessKey != "" && secretKey != "" {
-			identity.Credentials = append(identity.Credentials, &iam_pb.Credential{
-				AccessKey: accessKey,
-				SecretKey: secretKey,
-			})
+		// Never touch identities the driver did not create
+		if idx != -1 {
+			if err := s.claimIdentity(s3cfg.Identities[idx]); err != nil {
+				return err
+			}
 		}
-		s3cfg.Identities = append(s3cfg.Identities, &identity)
-	} else {
-		// Update existing user
-		if isDelete {
-			s3cfg.Identities = append(s3cfg.Identities[:idx], s3cfg.Identities[idx+1:]...)
-		} else {
+
+		if idx == -1 {
+			// Add new user
+			identity := iam_pb.Identity{
+				Name:        user,
+				Actions:     actions,
+				Credentials: []*iam_pb.Credential{},
+				Account:     s.managedIdentityAccount(),
+			}
 			if accessKey != "" && secretKey != "" {
-				s3cfg.Identities[idx].Credentials = append(s3cfg.Identities[idx].Credentials, &iam_pb.Credential{
+				identity.Credentials = append(identity.Credentials, &iam_pb.Credential{
 					AccessKey: accessKey,
 					SecretKey: secretKey,
 				})
 			}
-			for _, action := range actions {
-				if !contains(s3cfg.Identities[idx].Actions, action) {
-					s3cfg.Identities[idx].Actions = append(s3cfg.Identities[idx].Actions, action)
+			s3cfg.Identities = append(s3cfg.Identities, &identity)
+		} else {
+			// Update existing user
+			if isDelete {
+				s3cfg.Identities = append(s3cfg.Identities[:idx], s3cfg.Identities[idx+1:]...)
+			} else {
+				if accessKey != "" && secretKey != "" {
+					s3cfg.Identities[idx].Credentials = append(s3cfg.Identities[idx].Credentials, &iam_pb.Credential{
+						AccessKey: accessKey,
+						SecretKey: secretKey,
+					})
+				}
+				for _, action := range actions {
+					if !contains(s3cfg.Identities[idx].Actions, action) {
+						s3cfg.Identities[idx].Actions = append(s3cfg.Identities[idx].Actions, action)
+					}
 				}
 			}
 		}
+
+		return nil
+	})
+}
+
+// Apply a change to the S3 configuration. Changes are batched with concurrent
+// ones when the batcher is configured, otherwise they are written right away.
+// Changes that leave the configuration as it was are not written, so that the
+// S3 gateways do not reload it for nothing.
+func (s *provisionerServer) updateS3Configuration(ctx context.Context, apply func(*iam_pb.S3ApiConfiguration) error) error {
+	if s.s3ConfigBatcher != nil {
+		return s.s3ConfigBatcher.submit(ctx, apply)
 	}
 
-	buf.Reset()
-	filer.ProtoToText(&buf, s3cfg)
+	s3cfg, err := s.loadS3Configuration(ctx)
+	if err != nil {
+		return err
+	}
+	original := proto.Clone(s3cfg).(*iam_pb.S3ApiConfiguration)
+	_, span := startSpan(ctx, "iam.modify")
+	err = apply(s3cfg)
+	endSpan(span, err)
+	if err != nil || proto.Equal(original, s3cfg) {
+		return err
+	}
+	return s.storeS3Configuration(ctx, s3cfg)
+}
+
+// Get the current S3 configuration, from the cache if it is in sync with the Filer.
+func (s *provisionerServer) loadS3Configuration(ctx context.Context) (s3cfg *iam_pb.S3ApiConfiguration, err error) {
+	ctx, span := startSpan(ctx, "iam.read")
+	defer func() { endSpan(span, err) }()
+
+	if s.s3ConfigCache != nil {
+		if s3cfg, ok := s.s3ConfigCache.get(); ok {
+			span.SetAttributes(attribute.Bool("iam.cached", true))
+			return s3cfg, nil
+		}
+	}
+	return s.fetchS3Configuration(ctx)
+}
+
+// Read and parse the S3 configuration from the SeaweedFS Filer.
+func (s *provisionerServer) fetchS3Configuration(ctx context.Context) (*iam_pb.S3ApiConfiguration, error) {
+	var buf bytes.Buffer
+	if err := s.readS3Configuration(ctx, &buf); err != nil {
+		return nil, fmt.Errorf("failed to read S3 configuration: %w", err)
+	}
+
+	s3cfg := &iam_pb.S3ApiConfiguration{}
+	if buf.Len() > 0 {
+		if err := filer.ParseS3ConfigurationFromBytes(buf.Bytes(), s3cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse S3 configuration: %w", err)
+		}
+	}
+	observeIAMConfig(s.cluster, buf.Len(), len(s3cfg.GetIdentities()))
+
+	return s3cfg, nil
+}
+
+// Serialize and save the S3 configuration to the SeaweedFS Filer.
+func (s *provisionerServer) storeS3Configuration(ctx context.Context, s3cfg *iam_pb.S3ApiConfiguration) (err error) {
+	ctx, span := startSpan(ctx, "iam.save", attribute.Int("iam.identities", len(s3cfg.GetIdentities())))
+	defer func() { endSpan(span, err) }()
+
+	var buf bytes.Buffer
+	if err := filer.ProtoToText(&buf, s3cfg); err != nil {
+		return fmt.Errorf("failed to serialize S3 configuration: %w", err)
+	}
 
 	if err := s.saveS3Configuration(ctx, buf.Bytes()); err != nil {
-		return err
+		return fmt.Errorf("failed to save S3 configuration: %w", err)
+	}
+	observeIAMConfig(s.cluster, buf.Len(), len(s3cfg.GetIdentities()))
+
+	// Don't wait for the metadata event, the next change must already see this one.
+	if s.s3ConfigCache != nil {
+		s.s3ConfigCache.set(s3cfg)
 	}
 
 	return nil
@@ -259,13 +497,23 @@ func (s *provisionerServer) configureS3Access(ctx context.Context, user, accessK
 
 // Read the S3 configuration from the SeaweedFS Filer.
 func (s *provisionerServer) readS3Configuration(ctx context.Context, buf *bytes.Buffer) error {
-	entry, err := s.filerClient.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{
-		Directory: filer.IamConfigDirectory,
-		Name:      filer.IamIdentityFile,
+	return readFilerFile(ctx, s.filerClient, filer.IamConfigDirectory, filer.IamIdentityFile, buf)
+}
+
+// Save the S3 configuration to the SeaweedFS Filer.
+func (s *provisionerServer) saveS3Configuration(ctx context.Context, data []byte) error {
+	return saveFilerFile(ctx, s.filerClient, filer.IamConfigDirectory, filer.IamIdentityFile, data)
+}
+
+// Read the content of a file in the SeaweedFS Filer, leaving buf empty if the file does not exist.
+func readFilerFile(ctx context.Context, filerClient filer_pb.SeaweedFilerClient, dir, name string, buf *bytes.Buffer) error {
+	entry, err := filerClient.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{
+		Directory: dir,
+		Name:      name,
 	})
 	if err != nil {
 		// Handle the case where the file is not found
-		if strings.HasSuffix(err.Error(), "no entry is found in filer store") {
+		if isNotFound(err) {
 			return nil
 		}
 		return err
@@ -278,45 +526,48 @@ func (s *provisionerServer) readS3Configuration(ctx context.Context, buf *bytes.
 	return nil
 }
 
-// Save the S3 configuration to the SeaweedFS Filer.
-func (s *provisionerServer) saveS3Configuration(ctx context.Context, data []byte) error {
-	// Check if the S3 configuration file exists
-	_, err := s.filerClient.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{
-		Directory: filer.IamConfigDirectory,
-		Name:      filer.IamIdentityFile,
+// Save a file to the SeaweedFS Filer, creating it if it does not exist.
+func saveFilerFile(ctx context.Context, filerClient filer_pb.SeaweedFilerClient, dir, name string, data []byte) error {
+	// Check if the file exists
+	_, err := filerClient.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{
+		Directory: dir,
+		Name:      name,
 	})
 	if err != nil {
 		// Handle the case where the file is not found
-		if strings.HasSuffix(err.Error(), "no entry is found in filer store") {
-			// Create the S3 configuration file
-			_, createErr := s.filerClient.CreateEntry(ctx, &filer_pb.CreateEntryRequest{
-				Directory: filer.IamConfigDirectory,
+		if isNotFound(err) {
+			// Create the file
+			resp, createErr := filerClient.CreateEntry(ctx, &filer_pb.CreateEntryRequest{
+				Directory: dir,
 				Entry: &filer_pb.Entry{
-					Name:        filer.IamIdentityFile,
+					Name:        name,
 					Content:     data,
 					IsDirectory: false,
 				},
 			})
+			if createErr == nil && resp.GetError() != "" {
+				createErr = errors.New(resp.GetError())
+			}
 			if createErr != nil {
-				return fmt.Errorf("failed to create S3 configuration file: %w", createErr)
+				return fmt.Errorf("failed to create %s/%s: %w", dir, name, classifyError(createErr))
 			}
 			return nil
 		} else {
-			return fmt.Errorf("failed to check S3 configuration file: %w", err)
+			return fmt.Errorf("failed to check %s/%s: %w", dir, name, classifyError(err))
 		}
 	}
 
-	// Update the existing S3 configuration file
-	_, err = s.filerClient.UpdateEntry(ctx, &filer_pb.UpdateEntryRequest{
-		Directory: filer.IamConfigDirectory,
+	// Update the existing file
+	_, err = filerClient.UpdateEntry(ctx, &filer_pb.UpdateEntryRequest{
+		Directory: dir,
 		Entry: &filer_pb.Entry{
-			Name:        filer.IamIdentityFile,
+			Name:        name,
 			Content:     data,
 			IsDirectory: false,
 		},
 	})
 	if err != nil {
-		return fmt.Errorf("failed to update S3 configuration: %w", err)
+		return fmt.Errorf("failed to update %s/%s: %w", dir, name, err)
 	}
 
 	return nil
@@ -340,103 +591,125 @@ func (s *provisionerServer) DriverGrantBucketAccess(
 	userName := req.GetName()
 	bucketName := req.GetBucketId()
 	if userName == "" || bucketName == "" {
-		return nil, fmt.Errorf("user name or bucket name cannot be empty")
+		return nil, status.Error(codes.InvalidArgument, "user name or bucket name cannot be empty")
 	}
+	userName = s.identityPrefix + userName
 	klog.V(5).Infof("req %v", req)
 	klog.Info("Granting user accessPolicy to bucket ", "userName ", userName, " bucketName", bucketName)
+	if err := s.compatibility.check(); err != nil {
+		return nil, err
+	}
 
-	// Generate Access Key ID and Secret Access Key
-	accessKey, err := GenerateAccessKeyID()
+	prefix, err := normalizePrefix(req.GetParameters()[prefixParameter])
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate access key ID: %w", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	secretKey, err := GenerateSecretAccessKey()
+	ttl, err := parseCredentialTTL(req.GetParameters()[credentialTTLParameter])
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate secret access key: %w", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-
-	// Read current S3 configuration
-	var buf bytes.Buffer
-	if err := s.readS3Configuration(ctx, &buf); err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to read S3 configuration: %s", err))
+	if ttl > 0 && s.state == nil {
+		return nil, status.Error(codes.InvalidArgument, "credential TTL requires the driver state")
+	}
+	if ttl > 0 && s.credentialCheck <= 0 {
+		// Nothing would ever remove the expired credentials
+		return nil, status.Error(codes.InvalidArgument, "credential TTL requires a credential check interval")
 	}
 
-	s3cfg := &iam_pb.S3ApiConfiguration{}
-	if buf.Len() > 0 {
-		if err := filer.ParseS3ConfigurationFromBytes(buf.Bytes(), s3cfg); err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to parse S3 configuration: %s", err))
+	verbs := defaultAccessActions
+	var s3Actions []s3client.Action
+	if requested := parseActions(req.GetParameters()[actionsParameter]); len(requested) > 0 {
+		translation, err := translateS3Actions(requested)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
+		if len(translation.Broadened) > 0 {
+			klog.InfoS("granting more than the requested actions, SeaweedFS cannot grant them individually",
+				"userName", userName, "bucketName", bucketName, "actions", translation.Broadened)
+		}
+		verbs, s3Actions = translation.Actions, translation.S3Actions
 	}
 
-	// Find or create the identity for the user
-	var identity *iam_pb.Identity
-	for _, id := range s3cfg.Identities {
-		if id.Name == userName {
-			identity = id
-			break
-		}
+	// Grant the bucket actions to the user, together with new credentials
+	actions := bucketAccessActions(bucketName, prefix, verbs)
+
+	// The BucketAccessClass may override the location recorded for the bucket
+	location, err := s.bucketLocation(ctx, bucketName)
+	if err != nil {
+		klog.ErrorS(err, "failed to prepare bucket access", "bucketName", bucketName, "userName", userName)
+		return nil, rpcError(err, "failed to prepare bucket access")
+	}
+	if location, err = location.withParameters(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	if identity == nil {
-		identity = &iam_pb.Identity{
-			Name:        userName,
-			Actions:     []string{},
-			Credentials: []*iam_pb.Credential{},
+
+	caBundle, err := s.readCABundle()
+	if err != nil {
+		klog.ErrorS(err, "failed to prepare bucket access", "bucketName", bucketName, "userName", userName)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Mirror the grant in the bucket policy, so it can be inspected with S3 tooling.
+	// It is applied before keys are issued, a failure must not leave a usable key behind.
+	// Should the grant fail afterwards, the statements are dropped again.
+	granted := false
+	if s.s3Agent != nil {
+		if err := s.grantBucketPolicy(userName, bucketName, prefix, s3Actions); err != nil {
+			return nil, grantAccessError(err, bucketName, userName)
 		}
-		s3cfg.Identities = append(s3cfg.Identities, identity)
-	}
-
-	// Check if credentials already exist for the user
-	for _, cred := range identity.Credentials {
-		if cred.AccessKey == accessKey && cred.SecretKey == secretKey {
-			klog.InfoS("Credentials already exist for user", "userName", userName)
-			return &cosispec.DriverGrantBucketAccessResponse{
-				AccountId: userName,
-				Credentials: map[string]*cosispec.CredentialDetails{
-					"s3": {
-						Secrets: map[string]string{
-							"accessKeyID":     accessKey,
-							"accessSecretKey": secretKey,
-							"endpoint":        "",
-							"region":          "",
-						},
-					},
-				},
-			}, nil
+		defer func() {
+			if granted {
+				return
+			}
+			if err := s.revokeBucketPolicy(userName, bucketName); err != nil {
+				klog.ErrorS(err, "failed to revoke bucket policy of failed grant", "bucketName", bucketName, "userName", userName)
+			}
+		}()
+	}
+
+	var credentials map[string]string
+	switch authType := req.GetAuthenticationType(); authType {
+	case cosispec.AuthenticationType_IAM:
+		// SeaweedFS has no STS workloads could exchange their service account tokens at
+		return nil, status.Error(codes.InvalidArgument, "authentication type IAM is not supported by SeaweedFS")
+	case cosispec.AuthenticationType_Key, cosispec.AuthenticationType_UnknownAuthenticationType:
+		cred, err := s.identityBackend().grantAccess(ctx, userName, actions)
+		if err != nil {
+			return nil, grantAccessError(err, bucketName, userName)
 		}
-	}
 
-	// Add the new credentials to the identity
-	identity.Credentials = append(identity.Credentials, &iam_pb.Credential{
-		AccessKey: accessKey,
-		SecretKey: secretKey,
-	})
+		// Remember the credential for rotation, failing to do so only affects rotation.
+		// Credentials with a TTL are removed again if their expiry cannot be recorded.
+		// Without rotation or a TTL nothing needs the record, grants then leave the state alone.
+		if s.state != nil && (s.recordCredentials || ttl > 0) {
+			if err := s.recordCredential(ctx, userName, cred, ttl); err != nil {
+				klog.ErrorS(err, "failed to record credential", "userName", userName)
+				if ttl > 0 {
+					if err := s.identityBackend().deleteCredential(ctx, userName, cred.AccessKey); err != nil {
+						klog.ErrorS(err, "failed to remove unrecorded credential", "userName", userName)
+					}
+					return nil, rpcError(err, "failed to record credential expiry")
+				}
+			}
+		}
 
-	// Update actions for the identity
-	actions := []string{"Read", "Write", "List", "Tagging"}
-	for _, action := range actions {
-		fullAction := fmt.Sprintf("%s:%s", action, bucketName)
-		if !contains(identity.Actions, fullAction) {
-			identity.Actions = append(identity.Actions, fullAction)
+		credentials = map[string]string{
+			"accessKeyID":     cred.AccessKey,
+			"accessSecretKey": cred.SecretKey,
 		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unsupported authentication type %s", authType))
 	}
-
-	// Save updated S3 configuration
-	buf.Reset()
-	filer.ProtoToText(&buf, s3cfg)
-	if err := s.saveS3Configuration(ctx, buf.Bytes()); err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to save S3 configuration: %s", err))
+	if prefix != "" {
+		credentials[prefixParameter] = prefix
 	}
+	credentials["endpoint"] = location.Endpoint
+	credentials["region"] = location.Region
+	s.addConsumerSecrets(credentials, bucketName, location, caBundle)
 
+	granted = true
 	klog.InfoS("Successfully granted bucket access", "bucketName", bucketName, "userName", userName)
 
-	// Prepare the response with generated credentials
-	credentials := map[string]string{
-		"accessKeyID":     accessKey,
-		"accessSecretKey": secretKey,
-		"endpoint":        s.endpoint,
-		"region":          s.region,
-	}
-
 	return &cosispec.DriverGrantBucketAccessResponse{
 		AccountId: userName,
 		Credentials: map[string]*cosispec.CredentialDetails{
@@ -447,6 +720,54 @@ func (s *provisionerServer) DriverGrantBucketAccess(
 	}, nil
 }
 
+// normalizePrefix validates a key prefix access is limited to and makes it end with a slash.
+func normalizePrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "*?") {
+		return "", fmt.Errorf("invalid prefix %q", prefix)
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(prefix, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid prefix %q", prefix)
+		}
+	}
+	return strings.TrimSuffix(prefix, "/") + "/", nil
+}
+
+// parseCredentialTTL parses the lifetime of issued credentials, zero means they do not expire.
+func parseCredentialTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid credential TTL %q", value)
+	}
+	return ttl, nil
+}
+
+// bucketAccessActions returns the SeaweedFS actions granting the verbs on the
+// bucket, or only to the keys below the prefix if one is given.
+func bucketAccessActions(bucketName, prefix string, verbs []string) []string {
+	resource := bucketName
+	if prefix != "" {
+		resource = fmt.Sprintf("%s/%s*", bucketName, prefix)
+	}
+	actions := []string{}
+	for _, action := range verbs {
+		actions = append(actions, fmt.Sprintf("%s:%s", action, resource))
+	}
+	return actions
+}
+
+// grantAccessError logs the failure of a grant and converts it into the error returned by the RPC.
+func grantAccessError(err error, bucketName, userName string) error {
+	klog.ErrorS(err, "failed to grant bucket access", "bucketName", bucketName, "userName", userName)
+	return rpcError(err, "failed to grant bucket access")
+}
+
 // DriverRevokeBucketAccess call revokes all access to a particular bucket.
 func (s *provisionerServer) DriverRevokeBucketAccess(
 	ctx context.Context,
@@ -455,15 +776,42 @@ func (s *provisionerServer) DriverRevokeBucketAccess(
 	klog.InfoS("revoking bucket access", "user", req.GetAccountId())
 	userName := req.GetAccountId()
 	if userName == "" {
-		return nil, fmt.Errorf("user name cannot be empty")
+		return nil, status.Error(codes.InvalidArgument, "user name cannot be empty")
 	}
 	klog.InfoS("revoking bucket access", "user", userName)
+	if err := s.compatibility.check(); err != nil {
+		return nil, err
+	}
+
+	// Accounts handed out by the driver always carry the identity prefix
+	if !strings.HasPrefix(userName, s.identityPrefix) && !s.adoptIdentities {
+		err := fmt.Errorf("%w: %s", ErrIdentityNotManaged, userName)
+		klog.ErrorS(err, "refusing to revoke access", "user", userName)
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	if s.s3Agent != nil && req.GetBucketId() != "" {
+		err := s.revokeBucketPolicy(userName, req.GetBucketId())
+		var aerr awserr.Error
+		if err != nil && !(errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchBucket) {
+			klog.ErrorS(err, "failed to revoke bucket policy", "user", userName)
+			return nil, rpcError(err, "failed to revoke bucket access")
+		}
+	}
 
-	// Implement access revoke logic using SeaweedFS filer client
-	err := s.revokeBucketAccess(ctx, userName)
+	err := s.identityBackend().revokeAccess(ctx, userName)
 	if err != nil {
 		klog.ErrorS(err, "failed to revoke access", "user", userName)
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to revoke bucket access: %s", err))
+		return nil, rpcError(err, "failed to revoke bucket access")
+	}
+
+	// Forget the account, otherwise rotation would bring the identity back.
+	// The state is only written if the account was recorded.
+	if s.state != nil {
+		if err := s.forgetAccount(ctx, userName); err != nil {
+			klog.ErrorS(err, "failed to forget account", "user", userName)
+			return nil, rpcError(err, "failed to revoke bucket access")
+		}
 	}
 
 	return &cosispec.DriverRevokeBucketAccessResponse{}, nil
@@ -26,6 +26,8 @@ import (
 
 	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
 )
 
@@ -84,10 +86,10 @@ func Test_provisionerServer_DriverGrantBucketAccess(t *testing.T) {
 		ctx context.Context
 		req *cosispec.DriverGrantBucketAccessRequest
 	}
-	// Mocking the filer client
-	filerClient := &mockSeaweedFilerClient{
-		// Add any necessary mock implementations here
-	}
+	// Filer holding the bucket access is granted to
+	filer := newFakeFiler()
+	filer.write("", &filer_pb.Entry{Name: "test-bucket", IsDirectory: true})
+	filerClient := filer.client()
 	tests := []struct {
 		name    string
 		fields  fields
@@ -189,3 +191,90 @@ func Test_provisionerServer_DriverRevokeBucketAccess(t *testing.T) {
 		})
 	}
 }
+
+func Test_normalizePrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"team-a", "team-a/", false},
+		{"team-a/", "team-a/", false},
+		{"team-a/logs/", "team-a/logs/", false},
+		{"/team-a", "", true},
+		{"team-a//logs", "", true},
+		{"team-a/../team-b", "", true},
+		{"team-*", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got, err := normalizePrefix(tt.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("normalizePrefix() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("normalizePrefix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_provisionerServer_grantPrefixAccess(t *testing.T) {
+	ctx := context.Background()
+	s := &provisionerServer{
+		provisioner: "provisioner",
+		filerClient: newFakeFiler().client(),
+	}
+	createBuckets(t, s, "bucket")
+
+	resp, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{
+		BucketId:   "bucket",
+		Name:       "ba-1",
+		Parameters: map[string]string{"prefix": "team-a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix := resp.Credentials["s3"].Secrets["prefix"]; prefix != "team-a/" {
+		t.Errorf("expected prefix in secret, got %q", prefix)
+	}
+	want := []string{"Read:bucket/team-a/*", "Write:bucket/team-a/*", "List:bucket/team-a/*", "Tagging:bucket/team-a/*"}
+	if identity := findIdentity(t, s, "ba-1"); identity == nil || !reflect.DeepEqual(identity.Actions, want) {
+		t.Errorf("expected prefix-scoped actions %v, got %v", want, identity)
+	}
+
+	if _, err := s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{AccountId: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if identity := findIdentity(t, s, "ba-1"); identity != nil {
+		t.Errorf("expected identity to be removed, got %v", identity)
+	}
+
+	_, err = s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{
+		BucketId:   "bucket",
+		Name:       "ba-2",
+		Parameters: map[string]string{"prefix": "../team-b"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid prefix to be rejected, got %v", err)
+	}
+}
+
+func Test_provisionerServer_grantUnsupportedAuthenticationType(t *testing.T) {
+	for _, authType := range []cosispec.AuthenticationType{cosispec.AuthenticationType_IAM, cosispec.AuthenticationType(42)} {
+		s := newStatefulProvisionerServer()
+		_, err := s.DriverGrantBucketAccess(context.Background(), &cosispec.DriverGrantBucketAccessRequest{
+			BucketId:           "bucket",
+			Name:               "ba-1",
+			AuthenticationType: authType,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %s, got %v", authType, err)
+		}
+		if identity := findIdentity(t, s, "ba-1"); identity != nil {
+			t.Errorf("expected no identity to be created for %s, got %v", authType, identity)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"k8s.io/klog/v2"
+)
+
+// recordCredential remembers when a credential was handed out for the account.
+// With a TTL the credential is removed once it expires, as are the credentials
+// later rotated in for it. The TTL only applies to this credential, credentials
+// handed out earlier for the account keep their expiry.
+func (s *provisionerServer) recordCredential(ctx context.Context, account string, cred *iam_pb.Credential, ttl time.Duration) error {
+	return s.state.update(ctx, func(state *driverState) error {
+		acc, ok := state.Accounts[account]
+		if !ok {
+			acc = &accountState{}
+			state.Accounts[account] = acc
+		}
+		acc.Credentials = append(acc.Credentials, newCredentialRecord(cred, time.Now().UTC(), ttl))
+		return nil
+	})
+}
+
+func newCredentialRecord(cred *iam_pb.Credential, createdAt time.Time, ttl time.Duration) *credentialRecord {
+	record := &credentialRecord{
+		AccessKey: cred.AccessKey,
+		CreatedAt: createdAt,
+		TTL:       ttl,
+	}
+	if ttl > 0 {
+		expiresAt := createdAt.Add(ttl)
+		record.ExpiresAt = &expiresAt
+	}
+	return record
+}
+
+// forgetAccount drops the state of a revoked account.
+func (s *provisionerServer) forgetAccount(ctx context.Context, account string) error {
+	return s.state.update(ctx, func(state *driverState) error {
+		delete(state.Accounts, account)
+		return nil
+	})
+}
+
+// activeCredential returns the most recently issued credential of the account.
+func (s *provisionerServer) activeCredential(ctx context.Context, account string) (*credentialRecord, error) {
+	var active *credentialRecord
+	err := s.state.view(ctx, func(state *driverState) {
+		if acc, ok := state.Accounts[account]; ok {
+			if newest := acc.newestCredential(); newest != nil {
+				copied := *newest
+				active = &copied
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if active == nil {
+		return nil, fmt.Errorf("%w: %s", ErrAccountNotFound, account)
+	}
+	return active, nil
+}
+
+// rotateCredentials issues a new credential for the account and returns it
+// together with its secret key. The previous credentials of the account stay
+// valid for the rotation overlap and are removed afterwards.
+func (s *provisionerServer) rotateCredentials(ctx context.Context, account string) (*credentialRecord, string, error) {
+	if _, err := s.activeCredential(ctx, account); err != nil {
+		return nil, "", err
+	}
+
+	cred, err := s.identityBackend().grantAccess(ctx, account, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to issue new credential: %w", err)
+	}
+
+	now := time.Now().UTC()
+	retireAt := now.Add(s.rotationOverlap)
+	var rotated *credentialRecord
+	err = s.state.update(ctx, func(state *driverState) error {
+		acc, ok := state.Accounts[account]
+		if !ok {
+			// Revoked while rotating, the new credential went with the identity.
+			return fmt.Errorf("%w: %s", ErrAccountNotFound, account)
+		}
+		var ttl time.Duration
+		if newest := acc.newestCredential(); newest != nil {
+			ttl = newest.TTL
+		}
+		rotated = newCredentialRecord(cred, now, ttl)
+		for _, old := range acc.Credentials {
+			if old.ExpiresAt == nil || old.ExpiresAt.After(retireAt) {
+				old.ExpiresAt = &retireAt
+			}
+		}
+		acc.Credentials = append(acc.Credentials, rotated)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	klog.InfoS("rotated credentials", "account", account, "accessKey", rotated.AccessKey, "previousRetireAt", retireAt)
+	copied := *rotated
+	return &copied, cred.SecretKey, nil
+}
+
+// retireExpiredCredentials removes credentials past their expiry from their identities.
+func (s *provisionerServer) retireExpiredCredentials(ctx context.Context) error {
+	type expired struct {
+		account   string
+		accessKey string
+	}
+	var due []expired
+	now := time.Now()
+	err := s.state.view(ctx, func(state *driverState) {
+		for account, acc := range state.Accounts {
+			for _, cred := range acc.Credentials {
+				if cred.ExpiresAt != nil && !cred.ExpiresAt.After(now) {
+					due = append(due, expired{account, cred.AccessKey})
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range due {
+		if err := s.identityBackend().deleteCredential(ctx, e.account, e.accessKey); err != nil {
+			return fmt.Errorf("failed to remove expired credential of %s: %w", e.account, err)
+		}
+		err := s.state.update(ctx, func(state *driverState) error {
+			if acc, ok := state.Accounts[e.account]; ok {
+				for i, cred := range acc.Credentials {
+					if cred.AccessKey == e.accessKey {
+						acc.Credentials = append(acc.Credentials[:i], acc.Credentials[i+1:]...)
+						break
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		klog.InfoS("removed expired credential", "account", e.account, "accessKey", e.accessKey)
+	}
+	return nil
+}
+
+// reportAgedCredentials reports the accounts whose newest credential is older
+// than the maximum key age. They are not rotated: COSI cannot update the secret
+// of a BucketAccess, so the new key would never reach the consumer while its
+// current key would be removed after the overlap. Rotation is left to the admin API.
+func (s *provisionerServer) reportAgedCredentials(ctx context.Context) error {
+	if s.maxKeyAge <= 0 {
+		return nil
+	}
+
+	var aged []string
+	cutoff := time.Now().Add(-s.maxKeyAge)
+	err := s.state.view(ctx, func(state *driverState) {
+		for account, acc := range state.Accounts {
+			if newest := acc.newestCredential(); newest != nil && newest.CreatedAt.Before(cutoff) {
+				aged = append(aged, account)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(aged)
+	for _, account := range aged {
+		klog.InfoS("credentials are due for rotation", "account", account, "maxKeyAge", s.maxKeyAge)
+	}
+	agedAccounts.WithLabelValues(s.cluster).Set(float64(len(aged)))
+	return nil
+}
+
+// runCredentialMaintenance periodically reports aged and removes expired credentials until the context is cancelled.
+func (s *provisionerServer) runCredentialMaintenance(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.compatibility.check(); err != nil {
+			klog.V(4).InfoS("skipping credential maintenance", "err", err)
+			continue
+		}
+		release, err := s.leader.acquire()
+		if err != nil {
+			klog.V(4).InfoS("skipping credential maintenance", "err", err)
+			continue
+		}
+		if err := s.reportAgedCredentials(ctx); err != nil {
+			klog.ErrorS(err, "failed to check credential age")
+		}
+		if err := s.retireExpiredCredentials(ctx); err != nil {
+			klog.ErrorS(err, "failed to remove expired credentials")
+		}
+		release()
+	}
+}
@@ -0,0 +1,364 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+// newStatefulProvisionerServer returns a provisioner recording credentials, with a bucket named "bucket".
+func newStatefulProvisionerServer() *provisionerServer {
+	f := newFakeFiler()
+	f.write("/buckets", &filer_pb.Entry{Name: "bucket", IsDirectory: true})
+	filerClient := f.client()
+	return &provisionerServer{
+		provisioner:       "provisioner",
+		filerClient:       filerClient,
+		filerBucketsPath:  "/buckets",
+		state:             newStateStore(filerClient, "provisioner"),
+		recordCredentials: true,
+		rotationOverlap:   time.Hour,
+	}
+}
+
+func credentialKeys(t *testing.T, s *provisionerServer, account string) []string {
+	t.Helper()
+	identity := findIdentity(t, s, account)
+	if identity == nil {
+		return nil
+	}
+	keys := []string{}
+	for _, cred := range identity.Credentials {
+		keys = append(keys, cred.AccessKey)
+	}
+	return keys
+}
+
+func Test_provisionerServer_rotateCredentials(t *testing.T) {
+	ctx := context.Background()
+	s := newStatefulProvisionerServer()
+
+	resp, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := resp.Credentials["s3"].Secrets["accessKeyID"]
+
+	rotated, _, err := s.rotateCredentials(ctx, "ba-1")
+	if err != nil {
+		t.Fatalf("rotateCredentials() error = %v", err)
+	}
+
+	// Both keys are valid during the overlap.
+	if err := s.retireExpiredCredentials(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := credentialKeys(t, s, "ba-1"); len(keys) != 2 || keys[0] != granted || keys[1] != rotated.AccessKey {
+		t.Errorf("expected granted and rotated keys, got %v", keys)
+	}
+	if active, err := s.activeCredential(ctx, "ba-1"); err != nil || active.AccessKey != rotated.AccessKey {
+		t.Errorf("activeCredential() = %v, %v, want rotated key", active, err)
+	}
+
+	// Without overlap the previous keys are removed right away.
+	s.rotationOverlap = 0
+	rotated, _, err = s.rotateCredentials(ctx, "ba-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.retireExpiredCredentials(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := credentialKeys(t, s, "ba-1"); len(keys) != 1 || keys[0] != rotated.AccessKey {
+		t.Errorf("expected only the rotated key, got %v", keys)
+	}
+
+	if _, _, err := s.rotateCredentials(ctx, "unknown"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("expected unknown account to fail, got %v", err)
+	}
+
+	// Revoked accounts are forgotten.
+	if _, err := s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{AccountId: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.activeCredential(ctx, "ba-1"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("expected revoked account to be forgotten, got %v", err)
+	}
+}
+
+func Test_provisionerServer_reportAgedCredentials(t *testing.T) {
+	ctx := context.Background()
+	s := newStatefulProvisionerServer()
+	s.maxKeyAge = 90 * 24 * time.Hour
+
+	granted := map[string]string{}
+	for _, name := range []string{"old", "new"} {
+		resp, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		granted[name] = resp.Credentials["s3"].Secrets["accessKeyID"]
+	}
+	err := s.state.update(ctx, func(state *driverState) error {
+		state.Accounts["old"].Credentials[0].CreatedAt = time.Now().Add(-91 * 24 * time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.reportAgedCredentials(ctx); err != nil {
+		t.Fatalf("reportAgedCredentials() error = %v", err)
+	}
+	if aged := testutil.ToFloat64(agedAccounts.WithLabelValues("")); aged != 1 {
+		t.Errorf("expected 1 aged account, got %v", aged)
+	}
+
+	// The consumer never receives a replacement, so its key must keep working.
+	if err := s.retireExpiredCredentials(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range granted {
+		if keys := credentialKeys(t, s, name); len(keys) != 1 || keys[0] != key {
+			t.Errorf("expected %s to keep its original key %s, got %v", name, key, keys)
+		}
+		if active, err := s.activeCredential(ctx, name); err != nil || active.ExpiresAt != nil {
+			t.Errorf("expected key of %s not to expire, got %+v, %v", name, active, err)
+		}
+	}
+}
+
+func Test_provisionerServer_recordsOnlyWhenNeeded(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeFiler()
+	filerClient := f.client()
+	s := &provisionerServer{
+		provisioner:     "provisioner",
+		filerClient:     filerClient,
+		state:           newStateStore(filerClient, "provisioner"),
+		credentialCheck: time.Minute,
+	}
+	createBuckets(t, s, "bucket")
+	stateWritten := func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		_, ok := f.entries[stateDirectory+"/provisioner.json"]
+		return ok
+	}
+
+	// Without rotation nothing needs the credentials, grants and revokes leave the state alone.
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DriverRevokeBucketAccess(ctx, &cosispec.DriverRevokeBucketAccessRequest{AccountId: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if stateWritten() {
+		t.Errorf("expected grants without rotation or TTL not to write the state")
+	}
+
+	// Credentials with a TTL are recorded to be removed once they expire.
+	params := map[string]string{credentialTTLParameter: "1h"}
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-2", Parameters: params}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.activeCredential(ctx, "ba-2"); err != nil {
+		t.Errorf("expected credential with TTL to be recorded, got %v", err)
+	}
+}
+
+func Test_provisionerServer_adminHandler(t *testing.T) {
+	ctx := context.Background()
+	s := newStatefulProvisionerServer()
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.adminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/accounts/ba-1/rotate", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate returned %d: %s", rec.Code, rec.Body)
+	}
+	var rotated credentialResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &rotated); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.AccessSecretKey == "" {
+		t.Errorf("expected rotation to return the new secret key, got %+v", rotated)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/ba-1/credentials", nil))
+	var active credentialResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &active); err != nil {
+		t.Fatal(err)
+	}
+	if active.AccessKeyID != rotated.AccessKeyID || active.AccessSecretKey != "" {
+		t.Errorf("expected rotated credential to be active without its secret key, got %+v", active)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/accounts/unknown/rotate", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected unknown account to return 404, got %d", rec.Code)
+	}
+}
+
+func Test_requireToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	handler := requireToken(tokenFile, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic s3cr3t", http.StatusUnauthorized},
+		{"Bearer s3cr3t", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/accounts/ba-1/credentials", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q returned %d, want %d", tt.authorization, rec.Code, tt.want)
+		}
+	}
+}
+
+func Test_stateStore_doesNotRecordSecretKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newStatefulProvisionerServer()
+
+	resp, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := readFilerFile(ctx, s.filerClient, stateDirectory, "provisioner.json", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if secretKey := resp.Credentials["s3"].Secrets["accessSecretKey"]; buf.Len() == 0 || strings.Contains(buf.String(), secretKey) {
+		t.Errorf("expected the state to be saved without secret keys, got %s", buf.String())
+	}
+}
+
+func Test_provisionerServer_credentialTTL(t *testing.T) {
+	ctx := context.Background()
+	s := newStatefulProvisionerServer()
+	s.rotationOverlap = 0
+
+	req := &cosispec.DriverGrantBucketAccessRequest{
+		BucketId:   "bucket",
+		Name:       "ba-1",
+		Parameters: map[string]string{"credentialTTL": "1h"},
+	}
+
+	// Without credential checks expired credentials would never be removed.
+	if _, err := s.DriverGrantBucketAccess(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected TTL without credential checks to be rejected, got %v", err)
+	}
+	if identity := findIdentity(t, s, "ba-1"); identity != nil {
+		t.Errorf("expected no identity to be created, got %v", identity)
+	}
+
+	s.credentialCheck = time.Minute
+	if _, err := s.DriverGrantBucketAccess(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	active, err := s.activeCredential(ctx, "ba-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ExpiresAt == nil || !active.ExpiresAt.Equal(active.CreatedAt.Add(time.Hour)) {
+		t.Errorf("expected credential to expire after an hour, got %v", active.ExpiresAt)
+	}
+
+	// Rotated credentials inherit the TTL.
+	rotated, _, err := s.rotateCredentials(ctx, "ba-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ExpiresAt == nil || !rotated.ExpiresAt.Equal(rotated.CreatedAt.Add(time.Hour)) {
+		t.Errorf("expected rotated credential to expire after an hour, got %v", rotated.ExpiresAt)
+	}
+
+	// Later grants do not change the expiry of the credentials handed out before.
+	for _, ttl := range []string{"", "24h"} {
+		later := &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1", Parameters: map[string]string{"credentialTTL": ttl}}
+		if _, err := s.DriverGrantBucketAccess(ctx, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.state.view(ctx, func(state *driverState) {
+		for _, cred := range state.Accounts["ba-1"].Credentials {
+			if cred.AccessKey == rotated.AccessKey && (cred.ExpiresAt == nil || !cred.ExpiresAt.Equal(*rotated.ExpiresAt)) {
+				t.Errorf("expected rotated credential to keep its expiry %v, got %v", rotated.ExpiresAt, cred.ExpiresAt)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.state.update(ctx, func(state *driverState) error {
+		expired := time.Now().Add(-time.Minute)
+		for _, cred := range state.Accounts["ba-1"].Credentials {
+			cred.ExpiresAt = &expired
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.retireExpiredCredentials(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := credentialKeys(t, s, "ba-1"); len(keys) != 0 {
+		t.Errorf("expected expired credentials to be removed, got %v", keys)
+	}
+
+	for _, ttl := range []string{"forever", "-1h", "0s"} {
+		req.Parameters["credentialTTL"] = ttl
+		if _, err := s.DriverGrantBucketAccess(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected TTL %q to be rejected, got %v", ttl, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/filer"
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/klog/v2"
+)
+
+const (
+	s3ConfigCacheMinBackoff = time.Second
+	s3ConfigCacheMaxBackoff = 30 * time.Second
+)
+
+// s3ConfigCache keeps a parsed copy of the S3 IAM configuration in memory.
+// It is kept current by subscribing to metadata changes of the IAM config
+// directory on the filer and is only used while that subscription is healthy,
+// so that callers fall back to reading the filer directly otherwise.
+type s3ConfigCache struct {
+	filerClient filer_pb.SeaweedFilerClient
+	clientName  string
+	load        func(context.Context) (*iam_pb.S3ApiConfiguration, error)
+
+	mu         sync.RWMutex
+	config     *iam_pb.S3ApiConfiguration
+	generation uint64
+	healthy    bool
+}
+
+func newS3ConfigCache(
+	filerClient filer_pb.SeaweedFilerClient,
+	clientName string,
+	load func(context.Context) (*iam_pb.S3ApiConfiguration, error),
+) *s3ConfigCache {
+	return &s3ConfigCache{
+		filerClient: filerClient,
+		clientName:  clientName,
+		load:        load,
+	}
+}
+
+// get returns a copy of the cached configuration, or false if the cache cannot be trusted.
+func (c *s3ConfigCache) get() (*iam_pb.S3ApiConfiguration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.healthy || c.config == nil {
+		return nil, false
+	}
+	return proto.Clone(c.config).(*iam_pb.S3ApiConfiguration), true
+}
+
+// set replaces the cached configuration, e.g. after the driver saved it.
+func (c *s3ConfigCache) set(s3cfg *iam_pb.S3ApiConfiguration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = proto.Clone(s3cfg).(*iam_pb.S3ApiConfiguration)
+	c.generation++
+}
+
+// currentGeneration returns a counter that changes whenever the cached configuration is replaced.
+func (c *s3ConfigCache) currentGeneration() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation
+}
+
+// setIfUnchanged replaces the cached configuration unless it was replaced since the given generation.
+func (c *s3ConfigCache) setIfUnchanged(generation uint64, s3cfg *iam_pb.S3ApiConfiguration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return false
+	}
+	c.config = proto.Clone(s3cfg).(*iam_pb.S3ApiConfiguration)
+	c.generation++
+	return true
+}
+
+func (c *s3ConfigCache) setHealthy(healthy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.healthy = healthy
+}
+
+// run keeps the cache current until the context is cancelled, resubscribing
+// with exponential backoff whenever the subscription breaks.
+func (c *s3ConfigCache) run(ctx context.Context) {
+	backoff := s3ConfigCacheMinBackoff
+	for {
+		started := time.Now()
+		err := c.subscribe(ctx)
+		c.setHealthy(false)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > s3ConfigCacheMaxBackoff {
+			backoff = s3ConfigCacheMinBackoff
+		}
+		klog.ErrorS(err, "S3 configuration subscription failed, reading from filer until resubscribed", "retryIn", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, s3ConfigCacheMaxBackoff)
+	}
+}
+
+// subscribe primes the cache from the filer and applies metadata events until the stream breaks.
+func (c *s3ConfigCache) subscribe(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribe from before the initial read so that no change is missed in between.
+	sinceNs := time.Now().UnixNano()
+	stream, err := c.filerClient.SubscribeMetadata(ctx, &filer_pb.SubscribeMetadataRequest{
+		ClientName: c.clientName,
+		PathPrefix: filer.IamConfigDirectory,
+		SinceNs:    sinceNs,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to filer metadata: %w", err)
+	}
+
+	s3cfg, err := c.load(ctx)
+	if err != nil {
+		return err
+	}
+	c.set(s3cfg)
+	c.setHealthy(true)
+	klog.V(4).InfoS("S3 configuration cache is in sync", "identities", len(s3cfg.Identities))
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("failed to receive filer metadata: %w", err)
+		}
+		if err := c.apply(ctx, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// apply reloads the cache after a metadata event of the IAM config directory.
+// The content carried by the event is not used: an event of an earlier save may
+// arrive after the driver cached a newer configuration, and must not roll it back.
+func (c *s3ConfigCache) apply(ctx context.Context, resp *filer_pb.SubscribeMetadataResponse) error {
+	if resp.Directory != filer.IamConfigDirectory {
+		return nil
+	}
+	event := resp.GetEventNotification()
+	if event.GetOldEntry().GetName() != filer.IamIdentityFile && event.GetNewEntry().GetName() != filer.IamIdentityFile {
+		return nil
+	}
+
+	generation := c.currentGeneration()
+	s3cfg, err := c.load(ctx)
+	if err != nil {
+		return err
+	}
+	if !c.setIfUnchanged(generation, s3cfg) {
+		// The driver saved a change while reloading, its own event triggers the next reload.
+		klog.V(4).InfoS("S3 configuration saved while reloading, keeping the saved one")
+		return nil
+	}
+	klog.V(4).InfoS("S3 configuration changed on filer", "identities", len(s3cfg.Identities))
+	return nil
+}
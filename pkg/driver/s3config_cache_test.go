@@ -0,0 +1,167 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/filer"
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"github.com/seaweedfs/seaweedfs/weed/pb/iam_pb"
+	"google.golang.org/grpc"
+)
+
+type fakeSubscribeMetadataClient struct {
+	grpc.ClientStream
+	ctx    context.Context
+	events chan *filer_pb.SubscribeMetadataResponse
+}
+
+func (c *fakeSubscribeMetadataClient) Recv() (*filer_pb.SubscribeMetadataResponse, error) {
+	select {
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	case event, ok := <-c.events:
+		if !ok {
+			return nil, io.EOF
+		}
+		return event, nil
+	}
+}
+
+func identityFileEvent(t *testing.T, identities ...string) *filer_pb.SubscribeMetadataResponse {
+	t.Helper()
+	s3cfg := &iam_pb.S3ApiConfiguration{}
+	for _, name := range identities {
+		s3cfg.Identities = append(s3cfg.Identities, &iam_pb.Identity{Name: name})
+	}
+	var buf bytes.Buffer
+	if err := filer.ProtoToText(&buf, s3cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &filer_pb.SubscribeMetadataResponse{
+		Directory: filer.IamConfigDirectory,
+		EventNotification: &filer_pb.EventNotification{
+			NewEntry: &filer_pb.Entry{Name: filer.IamIdentityFile, Content: buf.Bytes()},
+		},
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_s3ConfigCache_setIfUnchanged(t *testing.T) {
+	c := newS3ConfigCache(nil, "provisioner", nil)
+	c.set(&iam_pb.S3ApiConfiguration{})
+	generation := c.currentGeneration()
+
+	saved := &iam_pb.S3ApiConfiguration{Identities: []*iam_pb.Identity{{Name: "saved"}}}
+	c.set(saved)
+	if c.setIfUnchanged(generation, &iam_pb.S3ApiConfiguration{}) {
+		t.Error("expected a reload started before a save to be discarded")
+	}
+	c.setHealthy(true)
+	if s3cfg, _ := c.get(); len(s3cfg.GetIdentities()) != 1 {
+		t.Errorf("expected the saved configuration to be kept, got %v", s3cfg)
+	}
+	if !c.setIfUnchanged(c.currentGeneration(), &iam_pb.S3ApiConfiguration{}) {
+		t.Error("expected a reload without concurrent saves to be applied")
+	}
+}
+
+func Test_s3ConfigCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := newFakeFiler()
+	events := make(chan *filer_pb.SubscribeMetadataResponse)
+	client := f.client()
+	client.subscribeMetadataFunc = func(ctx context.Context, in *filer_pb.SubscribeMetadataRequest, opts ...grpc.CallOption) (filer_pb.SeaweedFiler_SubscribeMetadataClient, error) {
+		return &fakeSubscribeMetadataClient{ctx: ctx, events: events}, nil
+	}
+	s := &provisionerServer{
+		provisioner: "provisioner",
+		filerClient: client,
+	}
+	if err := s.configureS3Access(ctx, "existing", "AK", "SK", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	s.s3ConfigCache = newS3ConfigCache(client, "provisioner", s.fetchS3Configuration)
+	go s.s3ConfigCache.run(ctx)
+
+	identities := func() []string {
+		s3cfg, ok := s.s3ConfigCache.get()
+		if !ok {
+			return nil
+		}
+		names := []string{}
+		for _, identity := range s3cfg.Identities {
+			names = append(names, identity.Name)
+		}
+		return names
+	}
+
+	// The cache is primed from the filer.
+	waitFor(t, func() bool { return len(identities()) == 1 && identities()[0] == "existing" })
+
+	// Changes made by others are picked up from metadata events.
+	added := identityFileEvent(t, "existing", "added")
+	f.write(added.Directory, added.EventNotification.NewEntry)
+	events <- added
+	waitFor(t, func() bool { return len(identities()) == 2 })
+
+	// Changes saved by the driver are visible right away.
+	if err := s.configureS3Access(ctx, "granted", "AK2", "SK2", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := identities(); len(got) != 3 || got[2] != "granted" {
+		t.Errorf("expected saved identity to be cached, got %v", got)
+	}
+
+	// A late event of an earlier save does not roll the cache back.
+	events <- added
+	events <- identityFileEvent(t)
+	if got := identities(); len(got) != 3 {
+		t.Errorf("expected late events to keep the saved identity, got %v", got)
+	}
+
+	// A broken subscription makes readers fall back to the filer.
+	close(events)
+	waitFor(t, func() bool {
+		_, ok := s.s3ConfigCache.get()
+		return !ok
+	})
+	s3cfg, err := s.loadS3Configuration(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s3cfg.Identities) != 3 {
+		t.Errorf("expected identities from filer, got %v", s3cfg.Identities)
+	}
+}
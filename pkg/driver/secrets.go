@@ -0,0 +1,88 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SignatureVersionV4 is the AWS signature version 4.
+	SignatureVersionV4 = "s3v4"
+	// SignatureVersionV2 is the legacy AWS signature version 2.
+	SignatureVersionV2 = "s3"
+)
+
+// Read the CA bundle handed out to bucket consumers. The file is read on every
+// grant, so a renewed CA is picked up without restarting the driver.
+func (s *provisionerServer) readCABundle() (string, error) {
+	if s.caBundleFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(s.caBundleFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	return string(data), nil
+}
+
+// addConsumerSecrets adds what clients need to know besides the credentials
+// to connect to the bucket, including ready-to-use AWS config files.
+func (s *provisionerServer) addConsumerSecrets(secrets map[string]string, bucketName string, location s3Location, caBundle string) {
+	secrets["bucketName"] = bucketName
+	secrets["pathStyle"] = strconv.FormatBool(s.pathStyle)
+	secrets["useTLS"] = strconv.FormatBool(strings.HasPrefix(location.Endpoint, "https://"))
+	if caBundle != "" {
+		secrets["caBundle"] = caBundle
+	}
+	if s.signatureVersion != "" {
+		secrets["signatureVersion"] = s.signatureVersion
+	}
+
+	// The config files are only of use together with keys, a profile without
+	// them would be rejected by the AWS SDKs
+	if accessKey, ok := secrets["accessKeyID"]; ok {
+		secrets["awsCredentials"] = fmt.Sprintf("[default]\naws_access_key_id = %s\naws_secret_access_key = %s\n",
+			accessKey, secrets["accessSecretKey"])
+		secrets["awsConfig"] = s.awsConfig(location)
+	}
+}
+
+// awsConfig returns an AWS shared config file for the location.
+func (s *provisionerServer) awsConfig(location s3Location) string {
+	var b strings.Builder
+	b.WriteString("[default]\n")
+	if location.Region != "" {
+		fmt.Fprintf(&b, "region = %s\n", location.Region)
+	}
+	if location.Endpoint != "" {
+		fmt.Fprintf(&b, "endpoint_url = %s\n", location.Endpoint)
+	}
+	b.WriteString("s3 =\n")
+	if s.pathStyle {
+		b.WriteString("  addressing_style = path\n")
+	} else {
+		b.WriteString("  addressing_style = virtual\n")
+	}
+	if s.signatureVersion != "" {
+		fmt.Fprintf(&b, "  signature_version = %s\n", s.signatureVersion)
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+func Test_provisionerServer_consumerSecrets(t *testing.T) {
+	ctx := context.Background()
+	caBundleFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caBundleFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newStatefulProvisionerServer()
+	s.endpoint = "https://s3.example.com"
+	s.region = "eu-west-1"
+	s.pathStyle = true
+	s.caBundleFile = caBundleFile
+	s.signatureVersion = SignatureVersionV4
+
+	resp, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"})
+	if err != nil {
+		t.Fatalf("DriverGrantBucketAccess() error = %v", err)
+	}
+	secrets := resp.Credentials["s3"].Secrets
+
+	want := map[string]string{
+		"bucketName":       "bucket",
+		"pathStyle":        "true",
+		"useTLS":           "true",
+		"caBundle":         "-----BEGIN CERTIFICATE-----\n",
+		"signatureVersion": "s3v4",
+	}
+	for key, value := range want {
+		if secrets[key] != value {
+			t.Errorf("secret %s = %q, want %q", key, secrets[key], value)
+		}
+	}
+	for _, line := range []string{"region = eu-west-1", "endpoint_url = https://s3.example.com", "addressing_style = path", "signature_version = s3v4"} {
+		if !strings.Contains(secrets["awsConfig"], line) {
+			t.Errorf("expected awsConfig to contain %q, got %q", line, secrets["awsConfig"])
+		}
+	}
+	if !strings.Contains(secrets["awsCredentials"], "aws_access_key_id = "+secrets["accessKeyID"]) ||
+		!strings.Contains(secrets["awsCredentials"], "aws_secret_access_key = "+secrets["accessSecretKey"]) {
+		t.Errorf("expected awsCredentials to hold the keys, got %q", secrets["awsCredentials"])
+	}
+
+	// A missing CA bundle fails the grant before any identity is touched.
+	s.caBundleFile = filepath.Join(t.TempDir(), "missing.crt")
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-2"}); status.Code(err) != codes.Internal {
+		t.Errorf("expected Internal for a missing CA bundle, got %v", err)
+	}
+	if identity := findIdentity(t, s, "ba-2"); identity != nil {
+		t.Errorf("expected no identity to be created, got %v", identity)
+	}
+}
+
+func Test_provisionerServer_awsConfig(t *testing.T) {
+	s := &provisionerServer{}
+	got := s.awsConfig(s3Location{Endpoint: "http://s3:8333"})
+	want := "[default]\nendpoint_url = http://s3:8333\ns3 =\n  addressing_style = virtual\n"
+	if got != want {
+		t.Errorf("awsConfig() = %q, want %q", got, want)
+	}
+}
+
+func Test_provisionerServer_addConsumerSecretsWithoutKeys(t *testing.T) {
+	s := &provisionerServer{}
+	secrets := map[string]string{}
+	s.addConsumerSecrets(secrets, "bucket", s3Location{Endpoint: "http://s3:8333"}, "")
+	for _, key := range []string{"awsConfig", "awsCredentials"} {
+		if _, ok := secrets[key]; ok {
+			t.Errorf("expected no %s without keys, got %q", key, secrets[key])
+		}
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/klog/v2"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+// identityHealthServer serves the gRPC health service next to the identity service.
+type identityHealthServer struct {
+	cosispec.IdentityServer
+	healthpb.HealthServer
+}
+
+// Serve serves the COSI services on the unix socket until the context is
+// cancelled, together with the gRPC health service if the identity server
+// implements it. All RPCs are traced and recorded in the metrics.
+func Serve(ctx context.Context, address string, identityServer cosispec.IdentityServer, provisionerServer cosispec.ProvisionerServer, opts ...grpc.ServerOption) error {
+	addr, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if addr.Scheme != "unix" {
+		return fmt.Errorf("address must be a unix domain socket, got %q", address)
+	}
+
+	listenConfig := net.ListenConfig{}
+	listener, err := listenConfig.Listen(ctx, "unix", addr.Path)
+	if err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+
+	opts = append([]grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(unaryServerMetrics),
+	}, opts...)
+	server := grpc.NewServer(opts...)
+	cosispec.RegisterIdentityServer(server, identityServer)
+	cosispec.RegisterProvisionerServer(server, provisionerServer)
+	if healthServer, ok := identityServer.(healthpb.HealthServer); ok {
+		healthpb.RegisterHealthServer(server, healthServer)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Serve(listener)
+	}()
+
+	select {
+	case <-ctx.Done():
+		server.GracefulStop()
+		// Hand the leadership over once the ongoing RPCs finished
+		if leader, ok := provisionerServer.(interface{ stepDown(context.Context) error }); ok {
+			stepDownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), leaderStepDownTimeout)
+			defer cancel()
+			if err := leader.stepDown(stepDownCtx); err != nil {
+				klog.ErrorS(err, "failed to step down as the leader")
+			}
+		}
+		return ctx.Err()
+	case err := <-errChan:
+		return err
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// startupHints tell how to resolve the failures of the startup checks, by check.
+var startupHints = map[string]string{
+	"filer":         "check the filer address and that the gRPC port of the filer, 18888 by default, is reachable",
+	"filer version": "run a filer of a SeaweedFS version the driver supports",
+	"identities":    "check that the S3 IAM configuration on the filer is valid, or the IAM endpoint and credentials",
+	"buckets":       "check that the filer keeps its buckets in /buckets",
+}
+
+// validate checks the configuration of the driver before it connects anywhere.
+func (opts Options) validate() error {
+	errs := opts.validateCluster()
+	if opts.AdminTokenFile != "" {
+		if _, err := readToken(opts.AdminTokenFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid admin token: %w", err))
+		}
+	} else if opts.AdminAddress != "" && !isLoopbackAddress(opts.AdminAddress) {
+		// The admin API hands out credentials, it must not be open to the network
+		errs = append(errs, fmt.Errorf("admin address %q is not a loopback address and no admin token file is configured", opts.AdminAddress))
+	}
+	for _, cluster := range opts.Clusters {
+		if err := errors.Join(opts.forCluster(cluster).validateCluster()...); err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %w", cluster.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateCluster checks the options addressing a single cluster.
+func (opts Options) validateCluster() []error {
+	var errs []error
+	filers := splitFilerAddresses(opts.FilerEndpoint)
+	if len(filers) == 0 && opts.MasterEndpoint == "" {
+		errs = append(errs, errors.New("no filer address configured"))
+	}
+	for _, address := range append(filers, opts.MasterEndpoint) {
+		// Addresses with a scheme are resolved by gRPC
+		if address == "" || strings.Contains(address, "/") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs = append(errs, fmt.Errorf("invalid address %q: %w", address, err))
+		}
+	}
+	if opts.Endpoint != "" {
+		if err := validateEndpoint(opts.Endpoint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.IdentityBackend == IdentityBackendIAM && opts.IAMEndpoint == "" {
+		errs = append(errs, errors.New("no IAM endpoint configured for the iam identity backend"))
+	}
+	if opts.BucketPolicy && opts.Endpoint == "" {
+		errs = append(errs, errors.New("no S3 endpoint configured for bucket policies"))
+	}
+	return errs
+}
+
+// checkStartup runs the checks once, each within the timeout, and returns a
+// summary of all failures with hints how to resolve them. The remaining checks
+// of a cluster are skipped once its filer is found unreachable, as they would
+// only fail the same way.
+func checkStartup(ctx context.Context, checks []readinessCheck, timeout time.Duration) error {
+	var failures []string
+	unreachable := map[string]bool{}
+	for _, c := range checks {
+		cluster, name := path.Split(c.name)
+		if unreachable[cluster] {
+			continue
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := c.check(checkCtx)
+		cancel()
+		if err == nil {
+			continue
+		}
+		unreachable[cluster] = name == "filer"
+		failure := fmt.Sprintf("%s: %v", c.name, err)
+		if hint, ok := startupHints[name]; ok {
+			failure += " (" + hint + ")"
+		}
+		failures = append(failures, failure)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("startup checks failed:\n- %s", strings.Join(failures, "\n- "))
+	}
+	klog.InfoS("startup checks passed")
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+	"github.com/seaweedfs/seaweedfs/weed/util"
+	"google.golang.org/grpc"
+)
+
+func TestOptions_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr string
+	}{
+		{"filer", Options{FilerEndpoint: "filer:18888", Endpoint: "https://s3.example.com"}, ""},
+		{"filers and master", Options{FilerEndpoint: "filer-0:18888, filer-1:18888", MasterEndpoint: "master:19333"}, ""},
+		{"master only", Options{MasterEndpoint: "master:19333"}, ""},
+		{"gRPC target", Options{FilerEndpoint: "dns:///filer:18888"}, ""},
+		{"no filer", Options{Endpoint: "https://s3.example.com"}, "no filer address configured"},
+		{"filer without port", Options{FilerEndpoint: "filer"}, `invalid address "filer"`},
+		{"invalid endpoint", Options{FilerEndpoint: "filer:18888", Endpoint: "s3.example.com"}, `invalid endpoint "s3.example.com"`},
+		{"invalid cluster", Options{FilerEndpoint: "filer:18888", Clusters: []ClusterOptions{{Name: "eu"}}}, "cluster eu: no filer address configured"},
+		{"iam backend without endpoint", Options{FilerEndpoint: "filer:18888", IdentityBackend: IdentityBackendIAM}, "no IAM endpoint configured"},
+		{"cluster without IAM endpoint", Options{FilerEndpoint: "filer:18888", IdentityBackend: IdentityBackendIAM, IAMEndpoint: "https://iam.example.com",
+			Clusters: []ClusterOptions{{Name: "eu", FilerEndpoint: "filer.eu:18888"}}}, "cluster eu: no IAM endpoint configured"},
+		{"cluster without S3 endpoint for bucket policies", Options{FilerEndpoint: "filer:18888", Endpoint: "https://s3.example.com", BucketPolicy: true,
+			Clusters: []ClusterOptions{{Name: "eu", FilerEndpoint: "filer.eu:18888"}}}, "cluster eu: no S3 endpoint configured"},
+		{"local admin API", Options{FilerEndpoint: "filer:18888", AdminAddress: "127.0.0.1:8090"}, ""},
+		{"exposed admin API", Options{FilerEndpoint: "filer:18888", AdminAddress: ":8090"}, `admin address ":8090" is not a loopback address`},
+		{"missing admin token", Options{FilerEndpoint: "filer:18888", AdminAddress: ":8090", AdminTokenFile: "/nonexistent"}, "invalid admin token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkStartup(t *testing.T) {
+	ctx := context.Background()
+	filer := newFakeFiler()
+	filerClient := filer.client()
+	s := &provisionerServer{
+		provisioner:      "provisioner",
+		filerClient:      filerClient,
+		filerBucketsPath: "/buckets",
+	}
+	var pingErr error
+	filerClient.pingFunc = func(ctx context.Context, in *filer_pb.PingRequest, opts ...grpc.CallOption) (*filer_pb.PingResponse, error) {
+		return &filer_pb.PingResponse{}, pingErr
+	}
+	major := util.MAJOR_VERSION
+	filerClient.getFilerConfigurationFunc = func(ctx context.Context, in *filer_pb.GetFilerConfigurationRequest, opts ...grpc.CallOption) (*filer_pb.GetFilerConfigurationResponse, error) {
+		return &filer_pb.GetFilerConfigurationResponse{MajorVersion: major, MinorVersion: util.MINOR_VERSION}, nil
+	}
+
+	// An unreachable filer is reported alone
+	pingErr = errors.New("connection refused")
+	err := checkStartup(ctx, s.readinessChecks(), time.Second)
+	if err == nil || err.Error() != "startup checks failed:\n- filer: connection refused (check the filer address and that the gRPC port of the filer, 18888 by default, is reachable)" {
+		t.Errorf("expected only the filer check to fail, got %v", err)
+	}
+
+	// Otherwise every failing check is reported with a hint
+	pingErr = nil
+	major = util.MAJOR_VERSION - 1
+	err = checkStartup(ctx, s.readinessChecks(), time.Second)
+	if err == nil {
+		t.Fatalf("expected startup checks to fail")
+	}
+	for _, want := range []string{
+		"- filer version: filer runs SeaweedFS",
+		"- buckets: ",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+
+	major = util.MAJOR_VERSION
+	filer.write("/", &filer_pb.Entry{Name: "buckets", IsDirectory: true})
+	if err := checkStartup(ctx, s.readinessChecks(), time.Second); err != nil {
+		t.Errorf("checkStartup() error = %v", err)
+	}
+}
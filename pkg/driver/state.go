@@ -0,0 +1,157 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/seaweedfs/weed/pb/filer_pb"
+)
+
+// stateDirectory is the directory in the Filer holding the state of the driver.
+const stateDirectory = "/etc/seaweedfs-cosi-driver"
+
+// credentialRecord tracks a credential handed out by the driver. The secret
+// key is not recorded, it is only known to the identity and the consumer.
+type credentialRecord struct {
+	AccessKey string    `json:"accessKey"`
+	CreatedAt time.Time `json:"createdAt"`
+	// TTL is how long the credential is valid, zero if it does not expire.
+	// Credentials rotated in for it are valid for as long.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// ExpiresAt is when the credential is removed from the identity, if ever.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// accountState is the state of an account handed out by the driver.
+type accountState struct {
+	Credentials []*credentialRecord `json:"credentials"`
+}
+
+// newestCredential returns the most recently issued credential of the account.
+func (a *accountState) newestCredential() *credentialRecord {
+	var newest *credentialRecord
+	for _, cred := range a.Credentials {
+		if newest == nil || cred.CreatedAt.After(newest.CreatedAt) {
+			newest = cred
+		}
+	}
+	return newest
+}
+
+// driverState is the state the driver keeps next to the SeaweedFS configuration.
+type driverState struct {
+	Accounts map[string]*accountState `json:"accounts"`
+	// IAMUsers are the users of the IAM API created or adopted by the driver.
+	IAMUsers map[string]bool `json:"iamUsers,omitempty"`
+}
+
+// stateStore persists the driver state as a JSON file in the Filer. The state
+// is read from the filer for every access instead of being kept in memory, so
+// that a replica taking over the leadership continues from the changes of the
+// previous leader instead of writing back what it read on startup. Only the
+// leader changes the state, the mutex orders the changes within the replica.
+type stateStore struct {
+	filerClient filer_pb.SeaweedFilerClient
+	directory   string
+	name        string
+
+	mu sync.Mutex
+}
+
+func newStateStore(filerClient filer_pb.SeaweedFilerClient, provisioner string) *stateStore {
+	return &stateStore{
+		filerClient: filerClient,
+		directory:   stateDirectory,
+		name:        provisioner + ".json",
+	}
+}
+
+// view calls fn with the current state, which must not be modified.
+func (st *stateStore) view(ctx context.Context, fn func(*driverState)) error {
+	lockObserved(&st.mu, "state")
+	defer st.mu.Unlock()
+
+	state, err := st.load(ctx)
+	if err != nil {
+		return err
+	}
+	fn(state)
+	return nil
+}
+
+// update applies fn to the current state and saves it if fn succeeds and changed it.
+func (st *stateStore) update(ctx context.Context, fn func(*driverState) error) error {
+	lockObserved(&st.mu, "state")
+	defer st.mu.Unlock()
+
+	state, err := st.load(ctx)
+	if err != nil {
+		return err
+	}
+	original, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to serialize driver state: %w", err)
+	}
+	if err := fn(state); err != nil {
+		return err
+	}
+
+	// Leave the file alone if nothing changed, e.g. when forgetting an unknown account
+	changed, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to serialize driver state: %w", err)
+	}
+	if bytes.Equal(original, changed) {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize driver state: %w", err)
+	}
+	if err := saveFilerFile(ctx, st.filerClient, st.directory, st.name, data); err != nil {
+		return fmt.Errorf("failed to save driver state: %w", err)
+	}
+	return nil
+}
+
+// load reads the state from the filer, an empty state if there is none yet.
+func (st *stateStore) load(ctx context.Context) (*driverState, error) {
+	var buf bytes.Buffer
+	if err := readFilerFile(ctx, st.filerClient, st.directory, st.name, &buf); err != nil {
+		return nil, fmt.Errorf("failed to read driver state: %w", err)
+	}
+
+	state := &driverState{}
+	if buf.Len() > 0 {
+		if err := json.Unmarshal(buf.Bytes(), state); err != nil {
+			return nil, fmt.Errorf("failed to parse driver state: %w", err)
+		}
+	}
+	if state.Accounts == nil {
+		state.Accounts = map[string]*accountState{}
+	}
+	if state.IAMUsers == nil {
+		state.IAMUsers = map[string]bool{}
+	}
+	return state, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	cosispec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+// recordSpans records the spans of the driver for the rest of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return exporter
+}
+
+func Test_provisionerServer_iamSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "DriverGrantBucketAccess")
+
+	s := newStatefulProvisionerServer()
+	if _, err := s.DriverGrantBucketAccess(ctx, &cosispec.DriverGrantBucketAccessRequest{BucketId: "bucket", Name: "ba-1"}); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	spans := map[string]bool{}
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "DriverGrantBucketAccess" {
+			continue
+		}
+		spans[span.Name] = true
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("expected span %s to be a child of the RPC span", span.Name)
+		}
+	}
+	for _, name := range []string{"iam.read", "iam.modify", "iam.save"} {
+		if !spans[name] {
+			t.Errorf("expected span %s, got %v", name, spans)
+		}
+	}
+}
+
+func TestSetupTracing(t *testing.T) {
+	shutdown, err := SetupTracing(context.Background(), TracesExporterNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() error = %v", err)
+	}
+
+	if _, err := SetupTracing(context.Background(), "zipkin"); err == nil {
+		t.Errorf("expected unknown exporter to fail")
+	}
+}
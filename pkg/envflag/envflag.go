@@ -20,6 +20,8 @@ package envflag
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func String(envKey string, defaultValue string, expectedValues ...string) string {
@@ -66,3 +68,31 @@ func Int(envKey string, defaultValue int) int {
 
 	return defaultValue
 }
+
+func Duration(envKey string, defaultValue time.Duration) time.Duration {
+	val, ok := os.LookupEnv(envKey)
+	if !ok {
+		return defaultValue
+	}
+
+	if actual, err := time.ParseDuration(val); err == nil {
+		return actual
+	}
+
+	return defaultValue
+}
+
+func StringList(envKey string, defaultValue []string) []string {
+	val, ok := os.LookupEnv(envKey)
+	if !ok {
+		return defaultValue
+	}
+
+	actual := []string{}
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			actual = append(actual, item)
+		}
+	}
+	return actual
+}
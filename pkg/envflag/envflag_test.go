@@ -21,7 +21,9 @@ package envflag_test
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/seaweedfs/seaweedfs-cosi-driver/pkg/envflag"
 )
@@ -263,3 +265,111 @@ func TestInts(t *testing.T) {
 		})
 	}
 }
+
+//nolint:paralleltest
+func TestDuration(t *testing.T) {
+	const (
+		DefaultValue = time.Second
+		Key          = "KEY"
+	)
+
+	for _, tc := range []struct {
+		name          string // required
+		key           string
+		value         string
+		defaultValue  time.Duration
+		expectedValue time.Duration
+	}{
+		{
+			name: "simple",
+		},
+		{
+			name:          "with default value",
+			defaultValue:  DefaultValue,
+			expectedValue: DefaultValue,
+		},
+		{
+			name:          "with actual value",
+			key:           Key,
+			value:         "150ms",
+			defaultValue:  DefaultValue,
+			expectedValue: 150 * time.Millisecond,
+		},
+		{
+			name:          "with invalid value",
+			key:           Key,
+			value:         "soon",
+			defaultValue:  DefaultValue,
+			expectedValue: DefaultValue,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.key != "" {
+				tc.key = fmt.Sprintf("TEST_%d_%s", rand.Intn(256), tc.key) // #nosec G404
+
+				t.Setenv(tc.key, tc.value)
+			}
+
+			actual := envflag.Duration(tc.key, tc.defaultValue)
+			if actual != tc.expectedValue {
+				t.Errorf("expected: %s, got: %s", tc.expectedValue, actual)
+			}
+		})
+	}
+}
+
+//nolint:paralleltest
+func TestStringList(t *testing.T) {
+	const (
+		Key = "KEY"
+	)
+	DefaultValue := []string{"default"}
+
+	for _, tc := range []struct {
+		name          string // required
+		key           string
+		value         string
+		defaultValue  []string
+		expectedValue []string
+	}{
+		{
+			name: "simple",
+		},
+		{
+			name:          "with default value",
+			defaultValue:  DefaultValue,
+			expectedValue: DefaultValue,
+		},
+		{
+			name:          "with actual value",
+			key:           Key,
+			value:         "a, b,,c",
+			defaultValue:  DefaultValue,
+			expectedValue: []string{"a", "b", "c"},
+		},
+		{
+			name:          "with empty value",
+			key:           Key,
+			value:         "",
+			defaultValue:  DefaultValue,
+			expectedValue: []string{},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.key != "" {
+				tc.key = fmt.Sprintf("TEST_%d_%s", rand.Intn(256), tc.key) // #nosec G404
+
+				t.Setenv(tc.key, tc.value)
+			}
+
+			actual := envflag.StringList(tc.key, tc.defaultValue)
+			if !reflect.DeepEqual(actual, tc.expectedValue) {
+				t.Errorf("expected: %v, got: %v", tc.expectedValue, actual)
+			}
+		})
+	}
+}
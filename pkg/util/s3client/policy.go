@@ -22,62 +22,63 @@ import (
 	"k8s.io/apimachinery/pkg/util/json"
 )
 
-type action string
+// Action is an "s3:*" action a PolicyStatement allows or denies
+type Action string
 
 const (
-	All                            action = "s3:*"
-	AbortMultipartUpload           action = "s3:AbortMultipartUpload"
-	CreateBucket                   action = "s3:CreateBucket"
-	DeleteBucketPolicy             action = "s3:DeleteBucketPolicy"
-	DeleteBucket                   action = "s3:DeleteBucket"
-	DeleteBucketWebsite            action = "s3:DeleteBucketWebsite"
-	DeleteObject                   action = "s3:DeleteObject"
-	DeleteObjectVersion            action = "s3:DeleteObjectVersion"
-	DeleteReplicationConfiguration action = "s3:DeleteReplicationConfiguration"
-	GetAccelerateConfiguration     action = "s3:GetAccelerateConfiguration"
-	GetBucketAcl                   action = "s3:GetBucketAcl"
-	GetBucketCORS                  action = "s3:GetBucketCORS"
-	GetBucketLocation              action = "s3:GetBucketLocation"
-	GetBucketLogging               action = "s3:GetBucketLogging"
-	GetBucketNotification          action = "s3:GetBucketNotification"
-	GetBucketPolicy                action = "s3:GetBucketPolicy"
-	GetBucketRequestPayment        action = "s3:GetBucketRequestPayment"
-	GetBucketTagging               action = "s3:GetBucketTagging"
-	GetBucketVersioning            action = "s3:GetBucketVersioning"
-	GetBucketWebsite               action = "s3:GetBucketWebsite"
-	GetLifecycleConfiguration      action = "s3:GetLifecycleConfiguration"
-	GetObjectAcl                   action = "s3:GetObjectAcl"
-	GetObject                      action = "s3:GetObject"
-	GetObjectTorrent               action = "s3:GetObjectTorrent"
-	GetObjectVersionAcl            action = "s3:GetObjectVersionAcl"
-	GetObjectVersion               action = "s3:GetObjectVersion"
-	GetObjectVersionTorrent        action = "s3:GetObjectVersionTorrent"
-	GetReplicationConfiguration    action = "s3:GetReplicationConfiguration"
-	ListAllMyBuckets               action = "s3:ListAllMyBuckets"
-	ListBucketMultiPartUploads     action = "s3:ListBucketMultiPartUploads"
-	ListBucket                     action = "s3:ListBucket"
-	ListBucketVersions             action = "s3:ListBucketVersions"
-	ListMultipartUploadParts       action = "s3:ListMultipartUploadParts"
-	PutAccelerateConfiguration     action = "s3:PutAccelerateConfiguration"
-	PutBucketAcl                   action = "s3:PutBucketAcl"
-	PutBucketCORS                  action = "s3:PutBucketCORS"
-	PutBucketLogging               action = "s3:PutBucketLogging"
-	PutBucketNotification          action = "s3:PutBucketNotification"
-	PutBucketPolicy                action = "s3:PutBucketPolicy"
-	PutBucketRequestPayment        action = "s3:PutBucketRequestPayment"
-	PutBucketTagging               action = "s3:PutBucketTagging"
-	PutBucketVersioning            action = "s3:PutBucketVersioning"
-	PutBucketWebsite               action = "s3:PutBucketWebsite"
-	PutLifecycleConfiguration      action = "s3:PutLifecycleConfiguration"
-	PutObjectAcl                   action = "s3:PutObjectAcl"
-	PutObject                      action = "s3:PutObject"
-	PutObjectVersionAcl            action = "s3:PutObjectVersionAcl"
-	PutReplicationConfiguration    action = "s3:PutReplicationConfiguration"
-	RestoreObject                  action = "s3:RestoreObject"
+	All                            Action = "s3:*"
+	AbortMultipartUpload           Action = "s3:AbortMultipartUpload"
+	CreateBucket                   Action = "s3:CreateBucket"
+	DeleteBucketPolicy             Action = "s3:DeleteBucketPolicy"
+	DeleteBucket                   Action = "s3:DeleteBucket"
+	DeleteBucketWebsite            Action = "s3:DeleteBucketWebsite"
+	DeleteObject                   Action = "s3:DeleteObject"
+	DeleteObjectVersion            Action = "s3:DeleteObjectVersion"
+	DeleteReplicationConfiguration Action = "s3:DeleteReplicationConfiguration"
+	GetAccelerateConfiguration     Action = "s3:GetAccelerateConfiguration"
+	GetBucketAcl                   Action = "s3:GetBucketAcl"
+	GetBucketCORS                  Action = "s3:GetBucketCORS"
+	GetBucketLocation              Action = "s3:GetBucketLocation"
+	GetBucketLogging               Action = "s3:GetBucketLogging"
+	GetBucketNotification          Action = "s3:GetBucketNotification"
+	GetBucketPolicy                Action = "s3:GetBucketPolicy"
+	GetBucketRequestPayment        Action = "s3:GetBucketRequestPayment"
+	GetBucketTagging               Action = "s3:GetBucketTagging"
+	GetBucketVersioning            Action = "s3:GetBucketVersioning"
+	GetBucketWebsite               Action = "s3:GetBucketWebsite"
+	GetLifecycleConfiguration      Action = "s3:GetLifecycleConfiguration"
+	GetObjectAcl                   Action = "s3:GetObjectAcl"
+	GetObject                      Action = "s3:GetObject"
+	GetObjectTorrent               Action = "s3:GetObjectTorrent"
+	GetObjectVersionAcl            Action = "s3:GetObjectVersionAcl"
+	GetObjectVersion               Action = "s3:GetObjectVersion"
+	GetObjectVersionTorrent        Action = "s3:GetObjectVersionTorrent"
+	GetReplicationConfiguration    Action = "s3:GetReplicationConfiguration"
+	ListAllMyBuckets               Action = "s3:ListAllMyBuckets"
+	ListBucketMultiPartUploads     Action = "s3:ListBucketMultiPartUploads"
+	ListBucket                     Action = "s3:ListBucket"
+	ListBucketVersions             Action = "s3:ListBucketVersions"
+	ListMultipartUploadParts       Action = "s3:ListMultipartUploadParts"
+	PutAccelerateConfiguration     Action = "s3:PutAccelerateConfiguration"
+	PutBucketAcl                   Action = "s3:PutBucketAcl"
+	PutBucketCORS                  Action = "s3:PutBucketCORS"
+	PutBucketLogging               Action = "s3:PutBucketLogging"
+	PutBucketNotification          Action = "s3:PutBucketNotification"
+	PutBucketPolicy                Action = "s3:PutBucketPolicy"
+	PutBucketRequestPayment        Action = "s3:PutBucketRequestPayment"
+	PutBucketTagging               Action = "s3:PutBucketTagging"
+	PutBucketVersioning            Action = "s3:PutBucketVersioning"
+	PutBucketWebsite               Action = "s3:PutBucketWebsite"
+	PutLifecycleConfiguration      Action = "s3:PutLifecycleConfiguration"
+	PutObjectAcl                   Action = "s3:PutObjectAcl"
+	PutObject                      Action = "s3:PutObject"
+	PutObjectVersionAcl            Action = "s3:PutObjectVersionAcl"
+	PutReplicationConfiguration    Action = "s3:PutReplicationConfiguration"
+	RestoreObject                  Action = "s3:RestoreObject"
 )
 
 // AllowedActions is a lenient default list of actions
-var AllowedActions = []action{
+var AllowedActions = []Action{
 	DeleteObject,
 	DeleteObjectVersion,
 	GetBucketAcl,
@@ -128,12 +129,20 @@ type PolicyStatement struct {
 	Effect effect `json:"Effect"`
 	// Principle is/are the Ceph user names affected by this PolicyStatement
 	// Must be in the format of 'arn:aws:iam:::user/<ceph-user>'
-	Principal map[string][]string `json:"Principal"`
+	Principal Principals `json:"Principal,omitempty"`
+	// NotPrincipal is/are the users not affected by this PolicyStatement, instead of Principal
+	NotPrincipal Principals `json:"NotPrincipal,omitempty"`
 	// Action is a list of s3:* actions
-	Action []action `json:"Action"`
+	Action ActionList `json:"Action,omitempty"`
+	// NotAction is a list of s3:* actions the PolicyStatement does not apply to, instead of Action
+	NotAction ActionList `json:"NotAction,omitempty"`
 	// Resource is the ARN identifier for the S3 resource (bucket)
 	// Must be in the format of 'arn:aws:s3:::<bucket>'
-	Resource []string `json:"Resource"`
+	Resource StringList `json:"Resource,omitempty"`
+	// NotResource is a list of ARNs the PolicyStatement does not apply to, instead of Resource
+	NotResource StringList `json:"NotResource,omitempty"`
+	// Condition (optional) limits when the PolicyStatement applies
+	Condition Condition `json:"Condition,omitempty"`
 }
 
 // BucketPolicy represents set of policy statements for a single bucket.
@@ -203,6 +212,7 @@ func (bp *BucketPolicy) ModifyBucketPolicy(ps ...PolicyStatement) *BucketPolicy
 		for j, oldP := range bp.Statement {
 			if newP.Sid == oldP.Sid {
 				bp.Statement[j] = newP
+				match = true
 			}
 		}
 		if !match {
@@ -240,8 +250,8 @@ func NewPolicyStatement() *PolicyStatement {
 	return &PolicyStatement{
 		Sid:       "",
 		Effect:    "",
-		Principal: map[string][]string{},
-		Action:    []action{},
+		Principal: Principals{},
+		Action:    []Action{},
 		Resource:  []string{},
 	}
 }
@@ -265,6 +275,23 @@ func (ps *PolicyStatement) ForPrincipals(users ...string) *PolicyStatement {
 	return ps
 }
 
+// ForAllPrincipals makes the PolicyStatement apply to everyone, including anonymous users
+func (ps *PolicyStatement) ForAllPrincipals() *PolicyStatement {
+	ps.Principal = Principals{wildcardPrincipal: nil}
+	return ps
+}
+
+// ForNotPrincipals adds users the PolicyStatement does not apply to
+func (ps *PolicyStatement) ForNotPrincipals(users ...string) *PolicyStatement {
+	if ps.NotPrincipal == nil {
+		ps.NotPrincipal = Principals{}
+	}
+	for _, u := range users {
+		ps.NotPrincipal[awsPrinciple] = append(ps.NotPrincipal[awsPrinciple], fmt.Sprintf(arnPrefixPrinciple, u))
+	}
+	return ps
+}
+
 // ForResources adds resources (buckets) to the PolicyStatement with the appropriate ARN prefix
 func (ps *PolicyStatement) ForResources(resources ...string) *PolicyStatement {
 	for _, v := range resources {
@@ -283,6 +310,22 @@ func (ps *PolicyStatement) ForSubResources(resources ...string) *PolicyStatement
 	return ps
 }
 
+// ForNotResources adds resources (buckets) the PolicyStatement does not apply to
+func (ps *PolicyStatement) ForNotResources(resources ...string) *PolicyStatement {
+	for _, v := range resources {
+		ps.NotResource = append(ps.NotResource, fmt.Sprintf(arnPrefixResource, v))
+	}
+	return ps
+}
+
+// ForNotSubResources adds contents inside the bucket the PolicyStatement does not apply to
+func (ps *PolicyStatement) ForNotSubResources(resources ...string) *PolicyStatement {
+	for _, v := range resources {
+		ps.NotResource = append(ps.NotResource, fmt.Sprintf(arnPrefixResource, fmt.Sprintf("%s/*", v)))
+	}
+	return ps
+}
+
 // Allows sets the effect of the PolicyStatement to allow PolicyStatement's Actions
 func (ps *PolicyStatement) Allows() *PolicyStatement {
 	if ps.Effect != "" {
@@ -302,11 +345,31 @@ func (ps *PolicyStatement) Denies() *PolicyStatement {
 }
 
 // Actions is the set of "s3:*" actions for the PolicyStatement is concerned
-func (ps *PolicyStatement) Actions(actions ...action) *PolicyStatement {
+func (ps *PolicyStatement) Actions(actions ...Action) *PolicyStatement {
 	ps.Action = actions
 	return ps
 }
 
+// NotActions is the set of "s3:*" actions the PolicyStatement does not apply to
+func (ps *PolicyStatement) NotActions(actions ...Action) *PolicyStatement {
+	ps.NotAction = actions
+	return ps
+}
+
+// WithCondition adds a condition comparing the key of a request with the values
+func (ps *PolicyStatement) WithCondition(operator ConditionOperator, key string, values ...string) *PolicyStatement {
+	if ps.Condition == nil {
+		ps.Condition = Condition{}
+	}
+	if ps.Condition[operator] == nil {
+		ps.Condition[operator] = map[string]ConditionValues{}
+	}
+	for _, v := range values {
+		ps.Condition[operator][key] = append(ps.Condition[operator][key], ConditionValue{Value: v})
+	}
+	return ps
+}
+
 func (ps *PolicyStatement) EjectPrincipals(users ...string) {
 	principals := ps.Principal[awsPrinciple]
 	for _, u := range users {
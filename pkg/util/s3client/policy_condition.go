@@ -0,0 +1,200 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	forAllValuesPrefix = "ForAllValues:"
+	forAnyValuePrefix  = "ForAnyValue:"
+	ifExistsSuffix     = "IfExists"
+)
+
+// conditionComparator compares a value of the request with a value of the condition
+type conditionComparator func(requestValue, conditionValue string) bool
+
+type conditionOperation struct {
+	compare conditionComparator
+	// negated operations are satisfied by request values matching none of the condition values
+	negated bool
+}
+
+var conditionOperations = map[ConditionOperator]conditionOperation{
+	StringEquals:              {compareStrings, false},
+	StringNotEquals:           {compareStrings, true},
+	StringEqualsIgnoreCase:    {strings.EqualFold, false},
+	StringNotEqualsIgnoreCase: {strings.EqualFold, true},
+	StringLike:                {compareLike, false},
+	StringNotLike:             {compareLike, true},
+	NumericEquals:             {compareNumbers(func(c int) bool { return c == 0 }), false},
+	NumericNotEquals:          {compareNumbers(func(c int) bool { return c == 0 }), true},
+	NumericLessThan:           {compareNumbers(func(c int) bool { return c < 0 }), false},
+	NumericLessThanEquals:     {compareNumbers(func(c int) bool { return c <= 0 }), false},
+	NumericGreaterThan:        {compareNumbers(func(c int) bool { return c > 0 }), false},
+	NumericGreaterThanEquals:  {compareNumbers(func(c int) bool { return c >= 0 }), false},
+	DateEquals:                {compareDates(func(c int) bool { return c == 0 }), false},
+	DateNotEquals:             {compareDates(func(c int) bool { return c == 0 }), true},
+	DateLessThan:              {compareDates(func(c int) bool { return c < 0 }), false},
+	DateLessThanEquals:        {compareDates(func(c int) bool { return c <= 0 }), false},
+	DateGreaterThan:           {compareDates(func(c int) bool { return c > 0 }), false},
+	DateGreaterThanEquals:     {compareDates(func(c int) bool { return c >= 0 }), false},
+	Bool:                      {strings.EqualFold, false},
+	BinaryEquals:              {compareStrings, false},
+	IpAddress:                 {compareIPAddress, false},
+	NotIpAddress:              {compareIPAddress, true},
+	ArnEquals:                 {compareStrings, false},
+	ArnLike:                   {compareLike, false},
+	ArnNotEquals:              {compareStrings, true},
+	ArnNotLike:                {compareLike, true},
+}
+
+// matches checks whether all conditions are satisfied by the condition keys of a request.
+// Conditions with unknown operators are never satisfied.
+func (c Condition) matches(context map[string][]string) bool {
+	for operator, keys := range c {
+		for key, values := range keys {
+			if !evaluateCondition(operator, key, values, context) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func evaluateCondition(operator ConditionOperator, key string, values ConditionValues, context map[string][]string) bool {
+	requestValues := context[key]
+
+	if operator == Null {
+		// "true" requires the key to be absent, "false" requires it to be present
+		for _, v := range values {
+			if strings.EqualFold(v.Value, "true") == (len(requestValues) == 0) {
+				return true
+			}
+		}
+		return false
+	}
+
+	op := string(operator)
+	forAll, forAny := strings.HasPrefix(op, forAllValuesPrefix), strings.HasPrefix(op, forAnyValuePrefix)
+	op = strings.TrimPrefix(strings.TrimPrefix(op, forAllValuesPrefix), forAnyValuePrefix)
+	ifExists := strings.HasSuffix(op, ifExistsSuffix)
+	op = strings.TrimSuffix(op, ifExistsSuffix)
+	operation, ok := conditionOperations[ConditionOperator(op)]
+	if !ok {
+		return false
+	}
+
+	if len(requestValues) == 0 {
+		switch {
+		case forAll:
+			return true
+		case forAny:
+			return false
+		default:
+			return ifExists || operation.negated
+		}
+	}
+
+	satisfies := func(requestValue string) bool {
+		for _, v := range values {
+			if operation.compare(requestValue, v.Value) {
+				return !operation.negated
+			}
+		}
+		return operation.negated
+	}
+	// Negated operations on multiple request values require all of them to match none of the values
+	all := forAll || (!forAny && operation.negated)
+	for _, requestValue := range requestValues {
+		if satisfies(requestValue) != all {
+			return !all
+		}
+	}
+	return all
+}
+
+func compareStrings(requestValue, conditionValue string) bool {
+	return requestValue == conditionValue
+}
+
+func compareLike(requestValue, conditionValue string) bool {
+	return matchWildcard(conditionValue, requestValue)
+}
+
+func compareNumbers(accept func(int) bool) conditionComparator {
+	return func(requestValue, conditionValue string) bool {
+		r, err := strconv.ParseFloat(requestValue, 64)
+		if err != nil {
+			return false
+		}
+		c, err := strconv.ParseFloat(conditionValue, 64)
+		if err != nil {
+			return false
+		}
+		switch {
+		case r < c:
+			return accept(-1)
+		case r > c:
+			return accept(1)
+		default:
+			return accept(0)
+		}
+	}
+}
+
+func compareDates(accept func(int) bool) conditionComparator {
+	return func(requestValue, conditionValue string) bool {
+		r, ok := parseConditionDate(requestValue)
+		if !ok {
+			return false
+		}
+		c, ok := parseConditionDate(conditionValue)
+		if !ok {
+			return false
+		}
+		return accept(r.Compare(c))
+	}
+}
+
+// parseConditionDate parses dates in ISO 8601 format or as seconds since the epoch
+func parseConditionDate(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05Z0700", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
+
+func compareIPAddress(requestValue, conditionValue string) bool {
+	ip := net.ParseIP(requestValue)
+	if ip == nil {
+		return false
+	}
+	if !strings.Contains(conditionValue, "/") {
+		return ip.Equal(net.ParseIP(conditionValue))
+	}
+	_, network, err := net.ParseCIDR(conditionValue)
+	return err == nil && network.Contains(ip)
+}
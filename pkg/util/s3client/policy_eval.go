@@ -0,0 +1,155 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Decision is the outcome of evaluating a request against a BucketPolicy
+type Decision int
+
+const (
+	// ImplicitDeny means no statement applies to the request
+	ImplicitDeny Decision = iota
+	// Allow means an Allow statement applies and no Deny statement does
+	Allow
+	// Deny means a Deny statement applies, regardless of any Allow statement
+	Deny
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "Allow"
+	case Deny:
+		return "Deny"
+	default:
+		return "ImplicitDeny"
+	}
+}
+
+// EvaluationRequest describes an S3 request to evaluate against a BucketPolicy
+type EvaluationRequest struct {
+	// Principal is a user name or an ARN in the format of 'arn:aws:iam:::user/<user>'
+	Principal string
+	// Action is the "s3:*" action of the request
+	Action Action
+	// Resource is the ARN of the bucket or object, e.g. 'arn:aws:s3:::<bucket>/<key>'
+	Resource string
+	// Context holds the values of the condition keys of the request, e.g. "aws:SourceIp"
+	Context map[string][]string
+}
+
+// EvaluationResult is the Decision for a request together with the statement it is based on
+type EvaluationResult struct {
+	Decision Decision
+	// Statement is the statement deciding the request, nil for an ImplicitDeny
+	Statement *PolicyStatement
+}
+
+// Evaluate decides whether the policy allows the request. An explicit Deny takes
+// precedence over any Allow, and requests no statement applies to are implicitly denied.
+func (bp *BucketPolicy) Evaluate(req EvaluationRequest) EvaluationResult {
+	principal := req.Principal
+	if !strings.HasPrefix(principal, "arn:") {
+		principal = fmt.Sprintf(arnPrefixPrinciple, principal)
+	}
+
+	result := EvaluationResult{Decision: ImplicitDeny}
+	for i := range bp.Statement {
+		ps := &bp.Statement[i]
+		if !ps.matches(principal, req) {
+			continue
+		}
+		switch ps.Effect {
+		case effectDeny:
+			return EvaluationResult{Decision: Deny, Statement: ps}
+		case effectAllow:
+			if result.Decision == ImplicitDeny {
+				result = EvaluationResult{Decision: Allow, Statement: ps}
+			}
+		}
+	}
+	return result
+}
+
+// matches checks whether the statement applies to the principal and the request
+func (ps *PolicyStatement) matches(principal string, req EvaluationRequest) bool {
+	return matchesEither(ps.Principal.matches(principal), len(ps.Principal), ps.NotPrincipal.matches(principal), len(ps.NotPrincipal)) &&
+		matchesEither(matchesAny(ps.Action, string(req.Action), true), len(ps.Action), matchesAny(ps.NotAction, string(req.Action), true), len(ps.NotAction)) &&
+		matchesEither(matchesAny(ps.Resource, req.Resource, false), len(ps.Resource), matchesAny(ps.NotResource, req.Resource, false), len(ps.NotResource)) &&
+		ps.Condition.matches(req.Context)
+}
+
+// matchesEither combines the match of an element like Action with its negated
+// counterpart like NotAction, a statement uses one of them
+func matchesEither(matched bool, elements int, notMatched bool, notElements int) bool {
+	if elements > 0 {
+		return matched
+	}
+	return notElements > 0 && !notMatched
+}
+
+// matches checks whether the principal is one of the principals
+func (p Principals) matches(principal string) bool {
+	if _, ok := p[wildcardPrincipal]; ok {
+		return true
+	}
+	return matchesAny(p[awsPrinciple], principal, false)
+}
+
+func matchesAny[T ~string](patterns []T, value string, ignoreCase bool) bool {
+	for _, pattern := range patterns {
+		p := string(pattern)
+		if ignoreCase {
+			p, value = strings.ToLower(p), strings.ToLower(value)
+		}
+		if matchWildcard(p, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard matches the value against a pattern where '*' matches any
+// sequence of characters, including '/', and '?' matches a single character
+func matchWildcard(pattern, value string) bool {
+	p, v := 0, 0
+	star, next := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]):
+			p++
+			v++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, v
+			p++
+		case star != -1:
+			// Let the last '*' match one more character
+			p = star + 1
+			next++
+			v = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import "testing"
+
+func TestBucketPolicy_Evaluate(t *testing.T) {
+	policy := NewBucketPolicy(
+		*NewPolicyStatement().
+			WithSID("read").
+			ForPrincipals("alice", "bob").
+			Allows().
+			Actions(GetObject, ListBucket).
+			ForResources("bucket").
+			ForSubResources("bucket"),
+		*NewPolicyStatement().
+			WithSID("write").
+			ForPrincipals("alice").
+			Allows().
+			Actions("s3:Put*").
+			ForSubResources("bucket/uploads"),
+		*NewPolicyStatement().
+			WithSID("secrets").
+			ForPrincipals("*").
+			Denies().
+			Actions(All).
+			ForSubResources("bucket/secret?"),
+	)
+
+	tests := []struct {
+		name    string
+		req     EvaluationRequest
+		want    Decision
+		wantSid string
+	}{
+		{"allowed read", EvaluationRequest{"bob", GetObject, "arn:aws:s3:::bucket/a/b", nil}, Allow, "read"},
+		{"allowed list", EvaluationRequest{"arn:aws:iam:::user/alice", ListBucket, "arn:aws:s3:::bucket", nil}, Allow, "read"},
+		{"action case is ignored", EvaluationRequest{"bob", "s3:getobject", "arn:aws:s3:::bucket/a", nil}, Allow, "read"},
+		{"wildcard action", EvaluationRequest{"alice", PutObject, "arn:aws:s3:::bucket/uploads/a", nil}, Allow, "write"},
+		{"other principal", EvaluationRequest{"bob", PutObject, "arn:aws:s3:::bucket/uploads/a", nil}, ImplicitDeny, ""},
+		{"other resource", EvaluationRequest{"alice", PutObject, "arn:aws:s3:::bucket/a", nil}, ImplicitDeny, ""},
+		{"other bucket", EvaluationRequest{"alice", GetObject, "arn:aws:s3:::bucket2/a", nil}, ImplicitDeny, ""},
+		{"explicit deny wins", EvaluationRequest{"alice", GetObject, "arn:aws:s3:::bucket/secret1/a", nil}, Deny, "secrets"},
+		{"single character wildcard", EvaluationRequest{"alice", GetObject, "arn:aws:s3:::bucket/secret/a", nil}, Allow, "read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policy.Evaluate(tt.req)
+			if got.Decision != tt.want {
+				t.Errorf("Evaluate() decision = %v, want %v", got.Decision, tt.want)
+			}
+			sid := ""
+			if got.Statement != nil {
+				sid = got.Statement.Sid
+			}
+			if sid != tt.wantSid {
+				t.Errorf("Evaluate() statement = %q, want %q", sid, tt.wantSid)
+			}
+		})
+	}
+}
+
+func Test_matchWildcard(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "a/b", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"abc", "abcd", false},
+	}
+	for _, tt := range tests {
+		if got := matchWildcard(tt.pattern, tt.value); got != tt.want {
+			t.Errorf("matchWildcard(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBucketPolicy_EvaluateConditions(t *testing.T) {
+	policy := NewBucketPolicy(
+		*NewPolicyStatement().
+			WithSID("internal").
+			ForAllPrincipals().
+			Allows().
+			Actions(GetObject).
+			ForSubResources("bucket").
+			WithCondition(IpAddress, "aws:SourceIp", "10.0.0.0/8"),
+		*NewPolicyStatement().
+			WithSID("tls").
+			ForAllPrincipals().
+			Denies().
+			Actions(All).
+			ForSubResources("bucket").
+			WithCondition(Bool, "aws:SecureTransport", "false"),
+		*NewPolicyStatement().
+			WithSID("uploads").
+			ForNotPrincipals("guest").
+			Allows().
+			NotActions(DeleteObject).
+			ForNotResources("other").
+			WithCondition("StringLikeIfExists", "s3:x-amz-acl", "private*"),
+	)
+
+	tests := []struct {
+		name    string
+		req     EvaluationRequest
+		want    Decision
+		wantSid string
+	}{
+		{
+			"source ip in network",
+			EvaluationRequest{"guest", GetObject, "arn:aws:s3:::bucket/a", map[string][]string{"aws:SourceIp": {"10.1.2.3"}}},
+			Allow, "internal",
+		},
+		{
+			"source ip outside network",
+			EvaluationRequest{"guest", GetObject, "arn:aws:s3:::bucket/a", map[string][]string{"aws:SourceIp": {"192.168.1.1"}}},
+			ImplicitDeny, "",
+		},
+		{
+			"insecure transport denied",
+			EvaluationRequest{"alice", GetObject, "arn:aws:s3:::bucket/a", map[string][]string{"aws:SourceIp": {"10.1.2.3"}, "aws:SecureTransport": {"false"}}},
+			Deny, "tls",
+		},
+		{
+			"not principal and not action",
+			EvaluationRequest{"alice", PutObject, "arn:aws:s3:::bucket/a", nil},
+			Allow, "uploads",
+		},
+		{
+			"excluded principal",
+			EvaluationRequest{"guest", PutObject, "arn:aws:s3:::bucket/a", nil},
+			ImplicitDeny, "",
+		},
+		{
+			"excluded action",
+			EvaluationRequest{"alice", DeleteObject, "arn:aws:s3:::bucket/a", nil},
+			ImplicitDeny, "",
+		},
+		{
+			"excluded resource",
+			EvaluationRequest{"alice", PutObject, "arn:aws:s3:::other", nil},
+			ImplicitDeny, "",
+		},
+		{
+			"condition key present",
+			EvaluationRequest{"alice", PutObject, "arn:aws:s3:::bucket/a", map[string][]string{"s3:x-amz-acl": {"public-read"}}},
+			ImplicitDeny, "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policy.Evaluate(tt.req)
+			sid := ""
+			if got.Statement != nil {
+				sid = got.Statement.Sid
+			}
+			if got.Decision != tt.want || sid != tt.wantSid {
+				t.Errorf("Evaluate() = %v %q, want %v %q", got.Decision, sid, tt.want, tt.wantSid)
+			}
+		})
+	}
+}
+
+func Test_evaluateCondition(t *testing.T) {
+	values := func(vs ...string) ConditionValues {
+		var cv ConditionValues
+		for _, v := range vs {
+			cv = append(cv, ConditionValue{Value: v})
+		}
+		return cv
+	}
+	tests := []struct {
+		name     string
+		operator ConditionOperator
+		values   ConditionValues
+		request  []string
+		want     bool
+	}{
+		{"string equals", StringEquals, values("a", "b"), []string{"b"}, true},
+		{"string equals missing key", StringEquals, values("a"), nil, false},
+		{"string not equals", StringNotEquals, values("a", "b"), []string{"c"}, true},
+		{"string not equals match", StringNotEquals, values("a", "b"), []string{"a"}, false},
+		{"string not equals missing key", StringNotEquals, values("a"), nil, true},
+		{"string equals ignore case", StringEqualsIgnoreCase, values("ABC"), []string{"abc"}, true},
+		{"string like", StringLike, values("home/*"), []string{"home/alice/"}, true},
+		{"string not like", StringNotLike, values("home/*"), []string{"tmp/"}, true},
+		{"numeric less than", NumericLessThan, values("10"), []string{"9"}, true},
+		{"numeric less than equal", NumericLessThan, values("10"), []string{"10"}, false},
+		{"numeric greater than equals", NumericGreaterThanEquals, values("10"), []string{"10"}, true},
+		{"numeric invalid", NumericEquals, values("10"), []string{"ten"}, false},
+		{"date less than", DateLessThan, values("2024-01-01T00:00:00Z"), []string{"2023-12-31T23:59:59Z"}, true},
+		{"date epoch", DateGreaterThan, values("2024-01-01T00:00:00Z"), []string{"1735689600"}, true},
+		{"bool", Bool, values("true"), []string{"TRUE"}, true},
+		{"ip address", IpAddress, values("192.168.0.1"), []string{"192.168.0.1"}, true},
+		{"not ip address", NotIpAddress, values("10.0.0.0/8"), []string{"10.0.0.1"}, false},
+		{"arn like", ArnLike, values("arn:aws:iam:::user/*"), []string{"arn:aws:iam:::user/alice"}, true},
+		{"arn not equals", ArnNotEquals, values("arn:aws:iam:::user/alice"), []string{"arn:aws:iam:::user/bob"}, true},
+		{"if exists missing key", "StringEqualsIfExists", values("a"), nil, true},
+		{"if exists present key", "StringEqualsIfExists", values("a"), []string{"b"}, false},
+		{"null missing key", Null, values("true"), nil, true},
+		{"null present key", Null, values("true"), []string{"a"}, false},
+		{"not null present key", Null, values("false"), []string{"a"}, true},
+		{"for all values", "ForAllValues:StringEquals", values("a", "b"), []string{"a", "b"}, true},
+		{"for all values partial", "ForAllValues:StringEquals", values("a"), []string{"a", "b"}, false},
+		{"for all values missing key", "ForAllValues:StringEquals", values("a"), nil, true},
+		{"for any value", "ForAnyValue:StringEquals", values("a"), []string{"c", "a"}, true},
+		{"for any value missing key", "ForAnyValue:StringEquals", values("a"), nil, false},
+		{"negated on multiple values", StringNotEquals, values("a"), []string{"b", "a"}, false},
+		{"unknown operator", "StringSoundsLike", values("a"), []string{"a"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			context := map[string][]string{}
+			if tt.request != nil {
+				context["key"] = tt.request
+			}
+			if got := evaluateCondition(tt.operator, "key", tt.values, context); got != tt.want {
+				t.Errorf("evaluateCondition() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
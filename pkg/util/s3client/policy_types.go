@@ -0,0 +1,192 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// wildcardPrincipal is the Principal matching everyone, including anonymous users
+const wildcardPrincipal = "*"
+
+// StringList is a list of strings that is also read from a single JSON string,
+// as policies written by hand often use a string for a single value.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	values, err := unmarshalValues(data)
+	if err != nil {
+		return err
+	}
+	*l = values
+	return nil
+}
+
+// ActionList is a list of actions that is also read from a single JSON string.
+type ActionList []Action
+
+func (l *ActionList) UnmarshalJSON(data []byte) error {
+	values, err := unmarshalValues(data)
+	if err != nil {
+		return err
+	}
+	actions := make(ActionList, 0, len(values))
+	for _, v := range values {
+		actions = append(actions, Action(v))
+	}
+	*l = actions
+	return nil
+}
+
+// Principals lists the principals of a PolicyStatement per type like "AWS".
+// The wildcard principal "*" is kept under the key "*".
+type Principals map[string][]string
+
+func (p Principals) MarshalJSON() ([]byte, error) {
+	if _, ok := p[wildcardPrincipal]; ok && len(p) == 1 {
+		return json.Marshal(wildcardPrincipal)
+	}
+	return json.Marshal(map[string][]string(p))
+}
+
+func (p *Principals) UnmarshalJSON(data []byte) error {
+	var wildcard string
+	if err := json.Unmarshal(data, &wildcard); err == nil {
+		if wildcard != wildcardPrincipal {
+			return fmt.Errorf("invalid principal %q", wildcard)
+		}
+		*p = Principals{wildcardPrincipal: nil}
+		return nil
+	}
+
+	var principals map[string]StringList
+	if err := json.Unmarshal(data, &principals); err != nil {
+		return err
+	}
+	*p = Principals{}
+	for kind, values := range principals {
+		(*p)[kind] = values
+	}
+	return nil
+}
+
+// ConditionOperator compares condition keys of a request with the values of a Condition.
+// Operators may carry an "IfExists" suffix and a "ForAllValues:" or "ForAnyValue:" prefix.
+type ConditionOperator string
+
+const (
+	StringEquals              ConditionOperator = "StringEquals"
+	StringNotEquals           ConditionOperator = "StringNotEquals"
+	StringEqualsIgnoreCase    ConditionOperator = "StringEqualsIgnoreCase"
+	StringNotEqualsIgnoreCase ConditionOperator = "StringNotEqualsIgnoreCase"
+	StringLike                ConditionOperator = "StringLike"
+	StringNotLike             ConditionOperator = "StringNotLike"
+	NumericEquals             ConditionOperator = "NumericEquals"
+	NumericNotEquals          ConditionOperator = "NumericNotEquals"
+	NumericLessThan           ConditionOperator = "NumericLessThan"
+	NumericLessThanEquals     ConditionOperator = "NumericLessThanEquals"
+	NumericGreaterThan        ConditionOperator = "NumericGreaterThan"
+	NumericGreaterThanEquals  ConditionOperator = "NumericGreaterThanEquals"
+	DateEquals                ConditionOperator = "DateEquals"
+	DateNotEquals             ConditionOperator = "DateNotEquals"
+	DateLessThan              ConditionOperator = "DateLessThan"
+	DateLessThanEquals        ConditionOperator = "DateLessThanEquals"
+	DateGreaterThan           ConditionOperator = "DateGreaterThan"
+	DateGreaterThanEquals     ConditionOperator = "DateGreaterThanEquals"
+	Bool                      ConditionOperator = "Bool"
+	BinaryEquals              ConditionOperator = "BinaryEquals"
+	IpAddress                 ConditionOperator = "IpAddress"
+	NotIpAddress              ConditionOperator = "NotIpAddress"
+	ArnEquals                 ConditionOperator = "ArnEquals"
+	ArnLike                   ConditionOperator = "ArnLike"
+	ArnNotEquals              ConditionOperator = "ArnNotEquals"
+	ArnNotLike                ConditionOperator = "ArnNotLike"
+	Null                      ConditionOperator = "Null"
+)
+
+// Condition maps operators to the condition keys they compare and the values
+// they compare them with, e.g. {"IpAddress": {"aws:SourceIp": ["10.0.0.0/8"]}}.
+type Condition map[ConditionOperator]map[string]ConditionValues
+
+// ConditionValues are the values of a condition key. Numbers and booleans are
+// kept in their JSON form, so they are written back the way they were read.
+type ConditionValues []ConditionValue
+
+func (v *ConditionValues) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] != '[' {
+		data = append(append([]byte{'['}, data...), ']')
+	}
+	var values []ConditionValue
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*v = values
+	return nil
+}
+
+// ConditionValue is a single value of a condition key.
+type ConditionValue struct {
+	// Value is the value as a string
+	Value string
+	// raw is the JSON form of numbers and booleans
+	raw json.RawMessage
+}
+
+func (v ConditionValue) MarshalJSON() ([]byte, error) {
+	if v.raw != nil {
+		return v.raw, nil
+	}
+	return json.Marshal(v.Value)
+}
+
+func (v *ConditionValue) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		*v = ConditionValue{}
+		return json.Unmarshal(data, &v.Value)
+	}
+
+	var scalar interface{}
+	if err := json.Unmarshal(data, &scalar); err != nil {
+		return err
+	}
+	switch scalar.(type) {
+	case bool, float64:
+	default:
+		return fmt.Errorf("invalid condition value %s", data)
+	}
+	*v = ConditionValue{Value: string(data), raw: append(json.RawMessage{}, data...)}
+	return nil
+}
+
+func unmarshalValues(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024 SeaweedFS contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	k8sjson "k8s.io/apimachinery/pkg/util/json"
+)
+
+func TestBucketPolicy_roundTrip(t *testing.T) {
+	// Written in the form the model writes back, so the round trip must not change it
+	policy := `{
+  "Id": "",
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Sid": "restricted",
+      "Effect": "Deny",
+      "Principal": "*",
+      "Action": [
+        "s3:*"
+      ],
+      "NotResource": [
+        "arn:aws:s3:::bucket/public/*"
+      ],
+      "Condition": {
+        "Bool": {
+          "aws:SecureTransport": [
+            false
+          ]
+        },
+        "NotIpAddress": {
+          "aws:SourceIp": [
+            "10.0.0.0/8",
+            "192.168.0.0/16"
+          ]
+        },
+        "NumericLessThanEquals": {
+          "s3:max-keys": [
+            10
+          ]
+        }
+      }
+    },
+    {
+      "Sid": "others",
+      "Effect": "Allow",
+      "NotPrincipal": {
+        "AWS": [
+          "arn:aws:iam:::user/alice"
+        ]
+      },
+      "NotAction": [
+        "s3:DeleteObject"
+      ],
+      "Resource": [
+        "arn:aws:s3:::bucket/*"
+      ],
+      "Condition": {
+        "ForAnyValue:StringLike": {
+          "s3:prefix": [
+            "home/*"
+          ]
+        }
+      }
+    }
+  ]
+}`
+
+	bp := &BucketPolicy{}
+	if err := k8sjson.Unmarshal([]byte(policy), bp); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.MarshalIndent(bp, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte(policy)) {
+		t.Errorf("policy changed on round trip:\n%s", data)
+	}
+}
+
+func TestBucketPolicy_singleValues(t *testing.T) {
+	policy := `{"Statement": [{"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam:::user/alice"},
+		"Action": "s3:GetObject", "Resource": "arn:aws:s3:::bucket/*",
+		"Condition": {"StringEquals": {"s3:x-amz-acl": "private"}}}]}`
+
+	bp := &BucketPolicy{}
+	if err := k8sjson.Unmarshal([]byte(policy), bp); err != nil {
+		t.Fatal(err)
+	}
+	ps := bp.Statement[0]
+	if len(ps.Principal["AWS"]) != 1 || len(ps.Action) != 1 || len(ps.Resource) != 1 {
+		t.Errorf("expected single values to be read as lists, got %+v", ps)
+	}
+	if values := ps.Condition[StringEquals]["s3:x-amz-acl"]; len(values) != 1 || values[0].Value != "private" {
+		t.Errorf("expected single condition value, got %v", values)
+	}
+}
+
+func TestPolicyStatement_builder(t *testing.T) {
+	ps := NewPolicyStatement().
+		WithSID("builder").
+		ForNotPrincipals("alice").
+		Denies().
+		NotActions(GetObject).
+		ForNotSubResources("bucket").
+		WithCondition(IpAddress, "aws:SourceIp", "10.0.0.0/8")
+
+	data, err := json.Marshal(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Sid":"builder","Effect":"Deny","NotPrincipal":{"AWS":["arn:aws:iam:::user/alice"]},` +
+		`"NotAction":["s3:GetObject"],"NotResource":["arn:aws:s3:::bucket/*"],` +
+		`"Condition":{"IpAddress":{"aws:SourceIp":["10.0.0.0/8"]}}}`
+	if string(data) != want {
+		t.Errorf("unexpected statement\n got: %s\nwant: %s", data, want)
+	}
+}